@@ -0,0 +1,250 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"containerd-hvf/pkg/api"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxReadLen bounds the data returned by a read, well below the ttrpc
+// message size limit.
+const maxReadLen = 1 << 20
+
+// agent implements api.AgentService.
+type agent struct {
+	mu        sync.Mutex
+	processes map[string]*process
+}
+
+func newAgent() *agent {
+	return &agent{processes: make(map[string]*process)}
+}
+
+// process is a process started by ExecProcess. Its output goes to pipes
+// read by the shim through ReadStdout and ReadStderr.
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+
+	done       chan struct{}
+	exitStatus uint32
+	exitedAt   time.Time
+}
+
+func (a *agent) getProcess(id string) (*process, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.processes[id]
+	if !ok {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrNotFound, "process %v", id))
+	}
+	return p, nil
+}
+
+func (a *agent) Ping(ctx context.Context, _ *emptypb.Empty) (*api.PingResponse, error) {
+	return &api.PingResponse{Version: version}, nil
+}
+
+func (a *agent) ExecProcess(ctx context.Context, r *api.ExecProcessRequest) (*api.ExecProcessResponse, error) {
+	if r.ExecId == "" || len(r.Args) == 0 {
+		return nil, errdefs.ToGRPC(errors.Wrap(errdefs.ErrInvalidArgument, "exec id and args are required"))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.processes[r.ExecId]; ok {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrAlreadyExists, "process %v", r.ExecId))
+	}
+
+	cmd := exec.Command(r.Args[0], r.Args[1:]...)
+	cmd.Env = r.Env
+	cmd.Dir = r.Cwd
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Credential: &syscall.Credential{Uid: r.Uid, Gid: r.Gid},
+	}
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	// The pipes are created by hand, as exec.Cmd closes its own ones once
+	// the process exits, possibly before the shim read all the output.
+	var childEnds []*os.File
+	defer func() {
+		for _, f := range childEnds {
+			f.Close()
+		}
+	}()
+	if r.Stdin {
+		stdinR, stdinW, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin, p.stdin = stdinR, stdinW
+		childEnds = append(childEnds, stdinR)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdout, p.stdout = stdoutW, stdoutR
+	cmd.Stderr, p.stderr = stderrW, stderrR
+	childEnds = append(childEnds, stdoutW, stderrW)
+
+	if err := cmd.Start(); err != nil {
+		for _, f := range []io.Closer{stdoutR, stderrR, p.stdin} {
+			if f != nil {
+				f.Close()
+			}
+		}
+		return nil, errors.Wrapf(err, "failed to start %v", r.Args[0])
+	}
+	a.processes[r.ExecId] = p
+	go p.wait(r.ExecId)
+	return &api.ExecProcessResponse{Pid: uint32(cmd.Process.Pid)}, nil
+}
+
+func (p *process) wait(id string) {
+	err := p.cmd.Wait()
+	status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	switch {
+	case ok && status.Signaled():
+		p.exitStatus = 128 + uint32(status.Signal())
+	case ok:
+		p.exitStatus = uint32(status.ExitStatus())
+	default:
+		logrus.WithError(err).WithField("exec", id).Error("failed to get exit status")
+		p.exitStatus = 255
+	}
+	p.exitedAt = time.Now()
+	close(p.done)
+}
+
+func (a *agent) SignalProcess(ctx context.Context, r *api.SignalProcessRequest) (*emptypb.Empty, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.done:
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrNotFound, "process %v already exited", r.ExecId))
+	default:
+	}
+	if err := p.cmd.Process.Signal(syscall.Signal(r.Signal)); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (a *agent) WaitProcess(ctx context.Context, r *api.WaitProcessRequest) (*api.WaitProcessResponse, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &api.WaitProcessResponse{
+		ExitStatus: p.exitStatus,
+		ExitedAt:   timestamppb.New(p.exitedAt),
+	}, nil
+}
+
+func (a *agent) RemoveProcess(ctx context.Context, r *api.RemoveProcessRequest) (*emptypb.Empty, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.done:
+	default:
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrFailedPrecondition, "process %v is running", r.ExecId))
+	}
+	a.mu.Lock()
+	delete(a.processes, r.ExecId)
+	a.mu.Unlock()
+	for _, f := range []io.Closer{p.stdout, p.stderr, p.stdin} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (a *agent) WriteStdin(ctx context.Context, r *api.WriteStreamRequest) (*api.WriteStreamResponse, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	if p.stdin == nil {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrFailedPrecondition, "process %v has no stdin", r.ExecId))
+	}
+	n, err := p.stdin.Write(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &api.WriteStreamResponse{Len: uint32(n)}, nil
+}
+
+func (a *agent) CloseStdin(ctx context.Context, r *api.CloseStdinRequest) (*emptypb.Empty, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	if p.stdin != nil {
+		if err := p.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return nil, err
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (a *agent) ReadStdout(ctx context.Context, r *api.ReadStreamRequest) (*api.ReadStreamResponse, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	return readStream(p.stdout, r.Len)
+}
+
+func (a *agent) ReadStderr(ctx context.Context, r *api.ReadStreamRequest) (*api.ReadStreamResponse, error) {
+	p, err := a.getProcess(r.ExecId)
+	if err != nil {
+		return nil, err
+	}
+	return readStream(p.stderr, r.Len)
+}
+
+func readStream(r io.Reader, n uint32) (*api.ReadStreamResponse, error) {
+	if n == 0 || n > maxReadLen {
+		n = maxReadLen
+	}
+	buf := make([]byte, n)
+	read, err := r.Read(buf)
+	if err == io.EOF || errors.Is(err, os.ErrClosed) {
+		return &api.ReadStreamResponse{Data: buf[:read], Eof: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.ReadStreamResponse{Data: buf[:read]}, nil
+}
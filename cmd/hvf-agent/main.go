@@ -0,0 +1,65 @@
+//go:build linux
+
+// hvf-agent runs inside the guest and serves the Agent API to the shim,
+// over virtio-vsock and the virtio-serial port of the VM, whichever the
+// host provides.
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"containerd-hvf/pkg/api"
+	"containerd-hvf/pkg/vsock"
+	"github.com/containerd/ttrpc"
+	"github.com/sirupsen/logrus"
+)
+
+// version is set at build time.
+var version = "dev"
+
+func main() {
+	port := flag.Uint("port", 1024, "vsock port to listen on")
+	serial := flag.String("serial", "/dev/virtio-ports/io.containerd.hvf.agent", "virtio-serial port to serve on")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	server, err := ttrpc.NewServer()
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to create server")
+	}
+	api.RegisterAgentService(server, newAgent())
+
+	var listeners []net.Listener
+	l, err := vsock.Listen(uint32(*port))
+	if err != nil {
+		logrus.WithError(err).Warn("not serving on vsock")
+	} else {
+		listeners = append(listeners, l)
+	}
+	if _, err := os.Stat(*serial); err != nil {
+		logrus.WithError(err).Warn("not serving on virtio-serial")
+	} else {
+		listeners = append(listeners, newSerialListener(*serial))
+	}
+	if len(listeners) == 0 {
+		logrus.Fatal("no vsock nor virtio-serial port to serve on")
+	}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			logrus.WithField("addr", l.Addr()).Info("serving agent API")
+			if err := server.Serve(ctx, l); err != nil && err != ttrpc.ErrServerClosed {
+				logrus.WithError(err).WithField("addr", l.Addr()).Error("failed to serve")
+				cancel()
+			}
+		}(l)
+	}
+	<-ctx.Done()
+	_ = server.Close()
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// serialListener serves a virtio-serial port as a listener of one
+// connection at a time. A port doesn't tell when the host side goes
+// away, so the port is only reopened once the server closed the last
+// connection on an error.
+type serialListener struct {
+	path   string
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSerialListener(path string) *serialListener {
+	l := &serialListener{
+		path:   path,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	l.ready <- struct{}{}
+	return l
+}
+
+func (l *serialListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.ready:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		l.ready <- struct{}{}
+		return nil, err
+	}
+	return &serialConn{File: f, l: l}, nil
+}
+
+func (l *serialListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *serialListener) Addr() net.Addr {
+	return serialAddr(l.path)
+}
+
+type serialAddr string
+
+func (a serialAddr) Network() string {
+	return "virtio-serial"
+}
+
+func (a serialAddr) String() string {
+	return string(a)
+}
+
+type serialConn struct {
+	*os.File
+	l    *serialListener
+	once sync.Once
+}
+
+func (c *serialConn) Close() error {
+	err := c.File.Close()
+	c.once.Do(func() { c.l.ready <- struct{}{} })
+	return err
+}
+
+func (c *serialConn) LocalAddr() net.Addr {
+	return c.l.Addr()
+}
+
+func (c *serialConn) RemoteAddr() net.Addr {
+	return serialAddr("host")
+}
@@ -0,0 +1,211 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"containerd-hvf/pkg/api"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times of /proc/stat, which
+// is 100 on every architecture Linux supports.
+const clockTicks = 100
+
+func (a *agent) ListProcesses(ctx context.Context, _ *emptypb.Empty) (*api.ListProcessesResponse, error) {
+	execs := make(map[int]string)
+	a.mu.Lock()
+	for id, p := range a.processes {
+		execs[p.cmd.Process.Pid] = id
+	}
+	a.mu.Unlock()
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.ListProcessesResponse{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			// Exited meanwhile.
+			continue
+		}
+		// The command is in parentheses and may contain spaces, the
+		// fields after it are "state ppid ...".
+		open, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(string(data[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		resp.Processes = append(resp.Processes, &api.GuestProcess{
+			Pid:     uint32(pid),
+			Ppid:    uint32(ppid),
+			Command: string(data[open+1 : end]),
+			ExecId:  execs[pid],
+		})
+	}
+	return resp, nil
+}
+
+func (a *agent) GetStats(ctx context.Context, _ *emptypb.Empty) (*api.GuestStats, error) {
+	stats := &api.GuestStats{}
+	cpu, err := readFields("/proc/stat", "cpu")
+	if err != nil {
+		return nil, err
+	}
+	// user nice system idle iowait irq softirq steal, idle and iowait not
+	// being usage.
+	for i, field := range cpu {
+		if i == 3 || i == 4 || i > 7 {
+			continue
+		}
+		ticks, _ := strconv.ParseUint(field, 10, 64)
+		stats.CpuUsageUsec += ticks * 1000000 / clockTicks
+	}
+	meminfo, err := readMeminfo()
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryTotalBytes = meminfo["MemTotal"]
+	stats.MemoryAvailableBytes = meminfo["MemAvailable"]
+
+	loadavg, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	// "0.01 0.05 0.10 1/123 4567", the fourth field being running/total
+	// processes.
+	fields := strings.Fields(string(loadavg))
+	if len(fields) >= 4 {
+		stats.Load1, _ = strconv.ParseFloat(fields[0], 64)
+		stats.Load5, _ = strconv.ParseFloat(fields[1], 64)
+		stats.Load15, _ = strconv.ParseFloat(fields[2], 64)
+		if _, total, ok := strings.Cut(fields[3], "/"); ok {
+			processes, _ := strconv.ParseUint(total, 10, 32)
+			stats.Processes = uint32(processes)
+		}
+	}
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(string(uptime)); len(fields) > 0 {
+		seconds, _ := strconv.ParseFloat(fields[0], 64)
+		stats.UptimeSeconds = uint64(seconds)
+	}
+	return stats, nil
+}
+
+// readFields returns the fields of the line of path starting with key.
+func readFields(path, key string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[0] == key {
+			return fields[1:], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("no %v in %v", key, path)
+}
+
+// readMeminfo returns the sizes of /proc/meminfo in bytes.
+func readMeminfo() (map[string]uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "MemTotal:        2013548 kB"
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			size *= 1024
+		}
+		res[key] = size
+	}
+	return res, scanner.Err()
+}
+
+func (a *agent) CopyFile(ctx context.Context, r *api.CopyFileRequest) (*emptypb.Empty, error) {
+	if !filepath.IsAbs(r.Path) || r.Offset < 0 {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrInvalidArgument, "invalid copy of %q at %v", r.Path, r.Offset))
+	}
+	mode := os.FileMode(r.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	flags := os.O_WRONLY
+	if r.Offset == 0 {
+		if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+			return nil, err
+		}
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(r.Path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if r.Offset == 0 {
+		// The file may exist with another mode.
+		if err := f.Chmod(mode); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.WriteAt(r.Data, r.Offset); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, f.Close()
+}
+
+func (a *agent) Shutdown(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty, error) {
+	logrus.Info("shutting down")
+	// Queue the poweroff without waiting, so that the reply makes it to the
+	// shim before the agent gets stopped.
+	out, err := exec.CommandContext(ctx, "systemctl", "--no-block", "poweroff").CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to power off: %s", out)
+	}
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,345 @@
+// hvfctl drives the VM specific API of running hvf shims.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"containerd-hvf/pkg/api"
+	"containerd-hvf/pkg/hvf"
+	"github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/containerd/ttrpc"
+)
+
+const defaultStateDir = "/var/run/containerd/io.containerd.runtime.v2.task"
+
+var (
+	namespace = flag.String("namespace", "default", "containerd namespace of the container")
+	stateDir  = flag.String("state", defaultStateDir, "state directory of the containerd v2 runtime")
+)
+
+const usage = `Usage: hvfctl [flags] <command> [args]
+
+Commands:
+  snapshot create [-description text] <id> <name>
+  snapshot ls <id>
+  snapshot revert <id> <name>
+  snapshot rm <id> <name>
+  commit [-label key=value]... <id> <ref> <output.tar>
+  cp [-mode mode] <id> <host file> <guest path>
+  screenshot <id> <output.png>
+  lifecycle <id>
+  domains
+  domain <id>
+  pack [-format oci|docker] [-arch arch]
+       [-kernel vmlinuz [-initrd initrd] [-cmdline cmdline]] <disk.qcow2> <cloud-init dir> <ref> <output.tar>
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "snapshot":
+		err = snapshot(flag.Args()[1:])
+	case "commit":
+		err = commit(flag.Args()[1:])
+	case "pack":
+		err = pack(flag.Args()[1:])
+	case "cp":
+		err = copyFile(flag.Args()[1:])
+	case "screenshot":
+		err = screenshot(flag.Args()[1:])
+	case "lifecycle":
+		err = lifecycle(flag.Args()[1:])
+	case "domains":
+		err = domains()
+	case "domain":
+		err = domain(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hvfctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// connect dials the shim of container id through the address it left in its
+// bundle.
+func connect(id string) (api.VMService, func(), error) {
+	address, err := os.ReadFile(filepath.Join(*stateDir, *namespace, id, "address"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find the shim of %v: %w", id, err)
+	}
+	conn, err := shim.AnonDialer(strings.TrimSpace(string(address)), 5*time.Second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the shim of %v: %w", id, err)
+	}
+	client := ttrpc.NewClient(conn)
+	return api.NewVMClient(client), func() { client.Close() }, nil
+}
+
+func snapshot(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing snapshot command")
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("snapshot create", flag.ExitOnError)
+		description := fs.String("description", "", "snapshot description")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: snapshot create [-description text] <id> <name>")
+		}
+		vm, closer, err := connect(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer closer()
+		_, err = vm.CreateSnapshot(ctx, &api.CreateSnapshotRequest{
+			Id:          fs.Arg(0),
+			Name:        fs.Arg(1),
+			Description: *description,
+		})
+		return err
+	case "ls":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: snapshot ls <id>")
+		}
+		vm, closer, err := connect(args[1])
+		if err != nil {
+			return err
+		}
+		defer closer()
+		resp, err := vm.ListSnapshots(ctx, &api.ListSnapshotsRequest{Id: args[1]})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPARENT\tMEMORY\tCREATED\tDESCRIPTION")
+		for _, s := range resp.Snapshots {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", s.Name, s.Parent, s.Memory,
+				s.CreatedAt.AsTime().Local().Format(time.RFC3339), s.Description)
+		}
+		return w.Flush()
+	case "revert", "rm":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: snapshot %v <id> <name>", args[0])
+		}
+		vm, closer, err := connect(args[1])
+		if err != nil {
+			return err
+		}
+		defer closer()
+		if args[0] == "revert" {
+			_, err = vm.RevertSnapshot(ctx, &api.RevertSnapshotRequest{Id: args[1], Name: args[2]})
+		} else {
+			_, err = vm.DeleteSnapshot(ctx, &api.DeleteSnapshotRequest{Id: args[1], Name: args[2]})
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+}
+
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelsFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expect key=value")
+	}
+	l[k] = v
+	return nil
+}
+
+func commit(args []string) error {
+	fs := flag.NewFlagSet("commit", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "image label, may be repeated")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		return fmt.Errorf("usage: commit [-label key=value]... <id> <ref> <output.tar>")
+	}
+	// The shim runs in another directory.
+	output, err := filepath.Abs(fs.Arg(2))
+	if err != nil {
+		return err
+	}
+	vm, closer, err := connect(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer closer()
+	resp, err := vm.Commit(context.Background(), &api.CommitRequest{
+		Id:     fs.Arg(0),
+		Ref:    fs.Arg(1),
+		Output: output,
+		Labels: labels,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.Digest)
+	return nil
+}
+
+// copyFile copies a host file into the guest through its agent.
+func copyFile(args []string) error {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	mode := fs.String("mode", "", "octal mode of the guest file, the one of the host file by default")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		return fmt.Errorf("usage: cp [-mode mode] <id> <host file> <guest path>")
+	}
+	var perm uint64
+	if *mode != "" {
+		var err error
+		perm, err = strconv.ParseUint(*mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q", *mode)
+		}
+	}
+	source, err := filepath.Abs(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	vm, closer, err := connect(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer closer()
+	_, err = vm.CopyFile(context.Background(), &api.CopyFileToGuestRequest{
+		Id:          fs.Arg(0),
+		Source:      source,
+		Destination: fs.Arg(2),
+		Mode:        uint32(perm),
+	})
+	return err
+}
+
+func screenshot(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: screenshot <id> <output.png>")
+	}
+	output, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+	vm, closer, err := connect(args[0])
+	if err != nil {
+		return err
+	}
+	defer closer()
+	_, err = vm.Screenshot(context.Background(), &api.ScreenshotRequest{Id: args[0], Output: output})
+	return err
+}
+
+// lifecycle prints the lifecycle state of a VM and how it got there.
+func lifecycle(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: lifecycle <id>")
+	}
+	vm, closer, err := connect(args[0])
+	if err != nil {
+		return err
+	}
+	defer closer()
+	resp, err := vm.Lifecycle(context.Background(), &api.LifecycleRequest{Id: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("State: %v\n\n", resp.State)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tFROM\tTO\tREASON")
+	for _, t := range resp.Transitions {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", t.At.AsTime().Local().Format(time.RFC3339), t.From, t.To, t.Reason)
+	}
+	return w.Flush()
+}
+
+// domains lists the libvirt domains of containers, of every namespace.
+func domains() error {
+	client, err := hvf.ConnectLibvirt()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+	owned, err := hvf.ListOwnedDomains(client)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tNAMESPACE\tCONTAINER\tIMAGE\tSHIM\tCREATED")
+	for _, d := range owned {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", d.Name, d.Owner.Namespace, d.Owner.ContainerID, d.Owner.Image,
+			d.Owner.ShimVersion, d.Owner.CreatedAt.Local().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// domain prints the libvirt domain name of a container, for virsh.
+func domain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: domain <id>")
+	}
+	client, err := hvf.ConnectLibvirt()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+	owned, err := hvf.LookupOwnedDomain(client, *namespace, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(owned.Name)
+	return nil
+}
+
+// pack builds an image locally, it doesn't need a shim.
+func pack(args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	opts := hvf.PackOptions{}
+	fs.StringVar(&opts.Format, "format", hvf.PackFormatOCI, "output format, oci or docker")
+	fs.StringVar(&opts.Arch, "arch", "arm64", "architecture of the guest")
+	fs.StringVar(&opts.Kernel, "kernel", "", "kernel to boot directly instead of the firmware")
+	fs.StringVar(&opts.Initrd, "initrd", "", "initrd of the kernel")
+	fs.StringVar(&opts.Cmdline, "cmdline", "", "command line of the kernel")
+	fs.Parse(args)
+	if fs.NArg() != 4 {
+		return fmt.Errorf("usage: pack [flags] <disk.qcow2> <cloud-init dir> <ref> <output.tar>")
+	}
+	opts.Disk = fs.Arg(0)
+	opts.CloudInit = fs.Arg(1)
+	opts.Ref = fs.Arg(2)
+	opts.Output = fs.Arg(3)
+	desc, err := hvf.Pack(&opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(desc.Digest)
+	return nil
+}
@@ -0,0 +1,157 @@
+// Code generated by protoc-gen-go-ttrpc. DO NOT EDIT.
+// source: hvf.proto
+package api
+
+import (
+	context "context"
+	ttrpc "github.com/containerd/ttrpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+type VMService interface {
+	CreateSnapshot(context.Context, *CreateSnapshotRequest) (*Snapshot, error)
+	ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error)
+	RevertSnapshot(context.Context, *RevertSnapshotRequest) (*emptypb.Empty, error)
+	DeleteSnapshot(context.Context, *DeleteSnapshotRequest) (*emptypb.Empty, error)
+	Commit(context.Context, *CommitRequest) (*CommitResponse, error)
+	CopyFile(context.Context, *CopyFileToGuestRequest) (*emptypb.Empty, error)
+	Screenshot(context.Context, *ScreenshotRequest) (*emptypb.Empty, error)
+	Lifecycle(context.Context, *LifecycleRequest) (*LifecycleResponse, error)
+}
+
+func RegisterVMService(srv *ttrpc.Server, svc VMService) {
+	srv.RegisterService("containerd.hvf.v1.VM", &ttrpc.ServiceDesc{
+		Methods: map[string]ttrpc.Method{
+			"CreateSnapshot": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req CreateSnapshotRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.CreateSnapshot(ctx, &req)
+			},
+			"ListSnapshots": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req ListSnapshotsRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.ListSnapshots(ctx, &req)
+			},
+			"RevertSnapshot": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req RevertSnapshotRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.RevertSnapshot(ctx, &req)
+			},
+			"DeleteSnapshot": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req DeleteSnapshotRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.DeleteSnapshot(ctx, &req)
+			},
+			"Commit": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req CommitRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.Commit(ctx, &req)
+			},
+			"CopyFile": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req CopyFileToGuestRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.CopyFile(ctx, &req)
+			},
+			"Screenshot": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req ScreenshotRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.Screenshot(ctx, &req)
+			},
+			"Lifecycle": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req LifecycleRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.Lifecycle(ctx, &req)
+			},
+		},
+	})
+}
+
+type vmClient struct {
+	client *ttrpc.Client
+}
+
+func NewVMClient(client *ttrpc.Client) VMService {
+	return &vmClient{
+		client: client,
+	}
+}
+
+func (c *vmClient) CreateSnapshot(ctx context.Context, req *CreateSnapshotRequest) (*Snapshot, error) {
+	var resp Snapshot
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "CreateSnapshot", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) ListSnapshots(ctx context.Context, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	var resp ListSnapshotsResponse
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "ListSnapshots", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) RevertSnapshot(ctx context.Context, req *RevertSnapshotRequest) (*emptypb.Empty, error) {
+	var resp emptypb.Empty
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "RevertSnapshot", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) DeleteSnapshot(ctx context.Context, req *DeleteSnapshotRequest) (*emptypb.Empty, error) {
+	var resp emptypb.Empty
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "DeleteSnapshot", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) Commit(ctx context.Context, req *CommitRequest) (*CommitResponse, error) {
+	var resp CommitResponse
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "Commit", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) CopyFile(ctx context.Context, req *CopyFileToGuestRequest) (*emptypb.Empty, error) {
+	var resp emptypb.Empty
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "CopyFile", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) Screenshot(ctx context.Context, req *ScreenshotRequest) (*emptypb.Empty, error) {
+	var resp emptypb.Empty
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "Screenshot", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *vmClient) Lifecycle(ctx context.Context, req *LifecycleRequest) (*LifecycleResponse, error) {
+	var resp LifecycleResponse
+	if err := c.client.Call(ctx, "containerd.hvf.v1.VM", "Lifecycle", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
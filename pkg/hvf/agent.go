@@ -0,0 +1,340 @@
+package hvf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"containerd-hvf/pkg/api"
+	"containerd-hvf/pkg/vsock"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/ttrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Transports of the agent API.
+const (
+	AgentTransportSerial = "serial"
+	AgentTransportVsock  = "vsock"
+)
+
+const (
+	// agentBinaryPath is the Linux build of hvf-agent shipped to guests,
+	// installed by `make install`.
+	agentBinaryPath = "/usr/local/share/containerd-hvf/hvf-agent"
+	// agentFileName is the agent on the cloud-init seed.
+	agentFileName = "hvf-agent"
+	// agentChannelName is the virtio-serial port, seen by the guest as
+	// /dev/virtio-ports/<name>.
+	agentChannelName = "io.containerd.hvf.agent"
+	agentPort        = 1024
+	// agentReadyTimeout leaves time for a first boot, which installs the
+	// agent.
+	agentReadyTimeout = 2 * time.Minute
+	// agentChunkSize is the size of the chunks of copied files, well below
+	// the ttrpc message size limit.
+	agentChunkSize = 1 << 20
+)
+
+// agentUnit runs the agent installed from the seed.
+const agentUnit = `[Unit]
+Description=containerd-hvf guest agent
+
+[Service]
+ExecStart=/usr/local/bin/hvf-agent
+Restart=always
+RestartSec=1
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// agentInstall copies the agent from the seed, which cloud-init doesn't
+// keep mounted.
+const agentInstall = `mkdir -p /run/hvf-seed && mount -o ro /dev/disk/by-label/cidata /run/hvf-seed && install -m 0755 /run/hvf-seed/hvf-agent /usr/local/bin/hvf-agent; umount /run/hvf-seed`
+
+// AgentConfig enables the guest agent.
+type AgentConfig struct {
+	Enabled   bool
+	Transport string
+	// Socket is the host side of the virtio-serial port.
+	Socket string
+}
+
+func parseAgent(annotations map[string]string) (AgentConfig, error) {
+	conf := AgentConfig{Transport: AgentTransportSerial}
+	if value, ok := annotations[AnnotationAgent]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return conf, fmt.Errorf("invalid %v %q", AnnotationAgent, value)
+		}
+		conf.Enabled = enabled
+	}
+	if value, ok := annotations[AnnotationAgentTransport]; ok {
+		switch value {
+		case AgentTransportSerial:
+			conf.Transport = value
+		case AgentTransportVsock:
+			if !vsock.Supported {
+				return conf, fmt.Errorf("invalid %v %q: %v", AnnotationAgentTransport, value, vsock.ErrUnsupported)
+			}
+			conf.Transport = value
+		default:
+			return conf, fmt.Errorf("invalid %v %q, expect serial or vsock", AnnotationAgentTransport, value)
+		}
+	}
+	return conf, nil
+}
+
+// setupAgent checks the agent is installed on the host and picks the
+// socket of its port.
+func (v *VM) setupAgent() error {
+	if !v.config.Agent.Enabled {
+		return nil
+	}
+	if _, err := os.Stat(agentBinaryPath); err != nil {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "the guest agent requires %v, build it with `make agent`", agentBinaryPath)
+	}
+	if v.config.Agent.Transport != AgentTransportSerial {
+		return nil
+	}
+	socket, err := v.socketPath("agent")
+	if err != nil {
+		return err
+	}
+	v.config.Agent.Socket = socket
+	return nil
+}
+
+// socketDir holds the host sockets of VMs, as bundle paths can exceed the
+// size of a unix socket path.
+const socketDir = "/var/run/containerd-hvf"
+
+// socketPath returns the path of the host socket named name of the VM.
+func (v *VM) socketPath(name string) (string, error) {
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(v.bundle))
+	return filepath.Join(socketDir, hex.EncodeToString(sum[:8])+"-"+name+".sock"), nil
+}
+
+// agentCloudConfig installs the agent as a systemd unit on first boot.
+func agentCloudConfig(conf *cloudConfig) {
+	conf.WriteFiles = append(conf.WriteFiles, writeFile{
+		Path:        "/etc/systemd/system/hvf-agent.service",
+		Permissions: "0644",
+		Content:     agentUnit,
+	})
+	conf.Runcmd = append(conf.Runcmd,
+		[]string{"sh", "-c", agentInstall},
+		[]string{"systemctl", "daemon-reload"},
+		[]string{"systemctl", "enable", "--now", "hvf-agent.service"},
+	)
+}
+
+// renderAgent adds the port the agent is reached through.
+func renderAgent(dom *libvirtxml.Domain, conf AgentConfig) {
+	if !conf.Enabled {
+		return
+	}
+	if conf.Transport == AgentTransportVsock {
+		dom.Devices.VSock = &libvirtxml.DomainVSock{
+			Model: "virtio",
+			CID:   &libvirtxml.DomainVSockCID{Auto: "yes"},
+		}
+		return
+	}
+	dom.Devices.Channels = append(dom.Devices.Channels, libvirtxml.DomainChannel{
+		Source: &libvirtxml.DomainChardevSource{
+			UNIX: &libvirtxml.DomainChardevSourceUNIX{Mode: "bind", Path: conf.Socket},
+		},
+		Target: &libvirtxml.DomainChannelTarget{
+			VirtIO: &libvirtxml.DomainChannelTargetVirtIO{Name: agentChannelName},
+		},
+	})
+}
+
+// agentClient returns the connected agent client, connecting it first if
+// needed.
+func (v *VM) agentClient() (api.AgentService, error) {
+	if !v.config.Agent.Enabled {
+		return nil, errors.Wrapf(errdefs.ErrNotImplemented, "the guest agent is disabled, set %v=true", AnnotationAgent)
+	}
+	v.agentMu.Lock()
+	defer v.agentMu.Unlock()
+	if v.agent != nil {
+		return api.NewAgentClient(v.agent), nil
+	}
+	conn, err := v.dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	var client *ttrpc.Client
+	client = ttrpc.NewClient(conn, ttrpc.WithOnClose(func() {
+		v.agentMu.Lock()
+		defer v.agentMu.Unlock()
+		if v.agent == client {
+			v.agent = nil
+		}
+	}))
+	v.agent = client
+	return api.NewAgentClient(client), nil
+}
+
+func (v *VM) dialAgent() (net.Conn, error) {
+	if v.config.Agent.Transport == AgentTransportSerial {
+		return net.Dial("unix", v.config.Agent.Socket)
+	}
+	xmlString, err := v.client.DomainGetXMLDesc(v.domainMeta, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get domain")
+	}
+	dom := &libvirtxml.Domain{}
+	if err := dom.Unmarshal(xmlString); err != nil {
+		return nil, err
+	}
+	if dom.Devices == nil || dom.Devices.VSock == nil || dom.Devices.VSock.CID == nil || dom.Devices.VSock.CID.Address == "" {
+		return nil, errors.Wrap(errdefs.ErrUnavailable, "no vsock CID assigned, is the VM running?")
+	}
+	cid, err := strconv.ParseUint(dom.Devices.VSock.CID.Address, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid vsock CID %q", dom.Devices.VSock.CID.Address)
+	}
+	return vsock.Dial(uint32(cid), agentPort)
+}
+
+// closeAgent drops the agent connection.
+func (v *VM) closeAgent() {
+	v.agentMu.Lock()
+	client := v.agent
+	v.agent = nil
+	v.agentMu.Unlock()
+	if client != nil {
+		_ = client.Close()
+	}
+}
+
+// waitAgent returns the agent client once the agent answers.
+func (v *VM) waitAgent(ctx context.Context) (api.AgentService, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentReadyTimeout)
+	defer cancel()
+	for {
+		client, err := v.agentClient()
+		if errdefs.IsNotImplemented(err) {
+			return nil, err
+		}
+		if err == nil {
+			pingCtx, pingCancel := context.WithTimeout(ctx, 2*time.Second)
+			_, err = client.Ping(pingCtx, &emptypb.Empty{})
+			pingCancel()
+			if err == nil {
+				return client, nil
+			}
+			// Start over, a request sent before the agent opened its port
+			// may still be queued.
+			v.closeAgent()
+		}
+		logrus.WithError(err).Debug("guest agent not ready")
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				v.screenshotOnTimeout()
+			}
+			return nil, errors.Wrapf(errdefs.ErrUnavailable, "guest agent of VM '%v' is not ready: %v", v.domain.Name, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Shutdown asks the guest to power off through the agent.
+func (v *VM) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client, err := v.agentClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.Shutdown(ctx, &emptypb.Empty{})
+	if err != nil {
+		return errors.Wrap(errdefs.FromGRPC(err), "failed to shut down guest")
+	}
+	return nil
+}
+
+// CopyFile copies the host file source to destination in the guest, with
+// the mode of source unless mode is set.
+func (v *VM) CopyFile(ctx context.Context, source, destination string, mode os.FileMode) error {
+	if !filepath.IsAbs(source) || !filepath.IsAbs(destination) {
+		return errors.Wrap(errdefs.ErrInvalidArgument, "source and destination must be absolute")
+	}
+	if err := v.checkRunning(); err != nil {
+		return err
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "%v is not a regular file", source)
+	}
+	if mode == 0 {
+		mode = stat.Mode().Perm()
+	}
+	client, err := v.waitAgent(ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, agentChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// The first chunk is sent even if empty, to create the file.
+		if n > 0 || offset == 0 {
+			_, err := client.CopyFile(ctx, &api.CopyFileRequest{
+				Path:   destination,
+				Mode:   uint32(mode),
+				Offset: offset,
+				Data:   buf[:n],
+			})
+			if err != nil {
+				return errors.Wrapf(errdefs.FromGRPC(err), "failed to copy to %v", destination)
+			}
+			offset += int64(n)
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// removeAgentSocket removes the socket libvirt leaves behind.
+func (v *VM) removeAgentSocket() error {
+	v.closeAgent()
+	if v.config.Agent.Socket == "" {
+		return nil
+	}
+	err := os.Remove(v.config.Agent.Socket)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
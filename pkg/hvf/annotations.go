@@ -0,0 +1,177 @@
+package hvf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Annotations recognised on the OCI spec, e.g.
+//
+//	ctr run --annotation io.containerd.hvf.net.0.mac=52:54:00:12:34:56 ...
+const annotationPrefix = "io.containerd.hvf."
+
+const (
+	// AnnotationNetworkPrefix configures the n-th network interface as
+	// io.containerd.hvf.net.<n>.<key>, keys being mode, source, model and mac,
+	// plus addresses, gateway, routes, mtu, nameservers and search for the
+	// static guest configuration.
+	AnnotationNetworkPrefix = annotationPrefix + "net."
+	// AnnotationFilesystemDriver selects how bind mounts are shared with the
+	// guest, virtiofs or 9p. Defaults to virtiofs if virtiofsd is installed.
+	AnnotationFilesystemDriver = annotationPrefix + "fs.driver"
+	// AnnotationVolumePrefix attaches an extra disk as
+	// io.containerd.hvf.disk.<name>.<key>, keys being source, format,
+	// readonly, cache, io and serial.
+	AnnotationVolumePrefix = annotationPrefix + "disk."
+	// AnnotationIOTunePrefix limits the I/O of a disk as
+	// io.containerd.hvf.iotune.<disk>.<key>, disk being root or the name of
+	// an extra disk and keys total_bytes_sec, read_bytes_sec, write_bytes_sec,
+	// total_iops_sec, read_iops_sec and write_iops_sec. They override the
+	// blkio throttles of the spec.
+	AnnotationIOTunePrefix = annotationPrefix + "iotune."
+	// AnnotationRootSize grows the root disk to the given size, e.g. 20G.
+	AnnotationRootSize = annotationPrefix + "root.size"
+	// AnnotationRootConvert set to true converts raw, vmdk and vhdx boot
+	// images to qcow2 once, when a per-container overlay is created.
+	AnnotationRootConvert = annotationPrefix + "root.convert"
+	// AnnotationRootDisk names a persistent root disk, kept in
+	// /var/lib/containerd-hvf/disks across containers. It is installed from
+	// the installer ISO when it doesn't exist yet.
+	AnnotationRootDisk = annotationPrefix + "root.disk"
+	// AnnotationInstallISO is a host installer ISO to install the guest from
+	// into a blank root disk, instead of booting the image's disk.
+	AnnotationInstallISO = annotationPrefix + "install.iso"
+	// AnnotationInstallSize is the size of the blank root disk, 20G by default.
+	AnnotationInstallSize = annotationPrefix + "install.size"
+	// AnnotationKernelCmdline is the command line of images booting their
+	// disk/vmlinuz directly, overriding their disk/cmdline.
+	AnnotationKernelCmdline = annotationPrefix + "kernel.cmdline"
+	// AnnotationFirmwareLoader is the UEFI firmware code to boot, along with
+	// the AnnotationFirmwareVars template. libvirt picks both by default.
+	AnnotationFirmwareLoader = annotationPrefix + "firmware.loader"
+	// AnnotationFirmwareVars is the template the NVRAM is created from.
+	AnnotationFirmwareVars = annotationPrefix + "firmware.vars"
+	// AnnotationFirmwareSecureBoot set to true enables Secure Boot, with the
+	// keys enrolled when libvirt picks the firmware.
+	AnnotationFirmwareSecureBoot = annotationPrefix + "firmware.secure-boot"
+	// AnnotationNVRAMName keeps the NVRAM in /var/lib/containerd-hvf/nvram
+	// under this name, instead of in the bundle.
+	AnnotationNVRAMName = annotationPrefix + "nvram.name"
+	// AnnotationNVRAMReset set to true recreates the NVRAM from the template.
+	AnnotationNVRAMReset = annotationPrefix + "nvram.reset"
+	// AnnotationTPM set to true adds a TPM 2.0 emulated by swtpm.
+	AnnotationTPM = annotationPrefix + "tpm"
+	// AnnotationRNG set to false removes the virtio-rng device.
+	AnnotationRNG = annotationPrefix + "rng"
+	// AnnotationWatchdog is what the guest watchdog does when it expires:
+	// reset (default), poweroff, pause, or none to remove it.
+	AnnotationWatchdog = annotationPrefix + "watchdog"
+	// AnnotationPanic is what is done when the guest panics: reset
+	// (default), poweroff, or none to remove the pvpanic device.
+	AnnotationPanic = annotationPrefix + "panic"
+	// AnnotationAgent set to true installs hvf-agent in the guest through
+	// cloud-init, giving exec, process listing, stats and file copy.
+	AnnotationAgent = annotationPrefix + "agent"
+	// AnnotationAgentTransport is how the shim reaches the agent, serial
+	// (default) or vsock. HVF hosts have no vhost-vsock, so vsock needs a
+	// QEMU and host supporting it.
+	AnnotationAgentTransport = annotationPrefix + "agent.transport"
+	// AnnotationGraphics is the remote display of the VM, none (default),
+	// vnc or spice, protected by a password generated in the bundle's
+	// graphics.json.
+	AnnotationGraphics = annotationPrefix + "graphics"
+	// AnnotationGraphicsListen is the address the display listens on,
+	// 127.0.0.1 by default, or unix for a Unix socket.
+	AnnotationGraphicsListen = annotationPrefix + "graphics.listen"
+	// AnnotationScreenshotOnTimeout set to true saves a screenshot next to
+	// the shim log when the guest agent isn't ready in time after start.
+	// It needs the agent.
+	AnnotationScreenshotOnTimeout = annotationPrefix + "screenshot.on-timeout"
+	// AnnotationIdentityLabels lists the annotations passed to the guest as
+	// SMBIOS OEM strings and fw_cfg entries, besides the namespace and ID.
+	AnnotationIdentityLabels = annotationPrefix + "identity.labels"
+	// AnnotationCloudInitSeed is a NoCloud seed URL cloud-init fetches, as
+	// told by the SMBIOS serial or the kernel command line, instead of
+	// reading the seed ISO. It can't be used with the agent.
+	AnnotationCloudInitSeed = annotationPrefix + "cloudinit.seed"
+	// AnnotationImage is the image reference recorded in the domain
+	// metadata, CRI containers having theirs already.
+	AnnotationImage = annotationPrefix + "image"
+	// AnnotationImageRepair set to "leaks" or "all" boots a copy of dirty or
+	// corrupt boot images repaired by `qemu-img check -r` instead of refusing
+	// them.
+	AnnotationImageRepair = annotationPrefix + "image.repair"
+)
+
+// namedAnnotations groups annotations like "<prefix><name>.<key>=<value>" by name.
+func namedAnnotations(annotations map[string]string, prefix string) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name, key, ok := strings.Cut(strings.TrimPrefix(k, prefix), ".")
+		if !ok {
+			continue
+		}
+		if res[name] == nil {
+			res[name] = make(map[string]string)
+		}
+		res[name][key] = v
+	}
+	return res
+}
+
+// indexedAnnotations groups annotations like "<prefix><n>.<key>=<value>" by n.
+func indexedAnnotations(annotations map[string]string, prefix string) (map[int]map[string]string, error) {
+	res := make(map[int]map[string]string)
+	for name, conf := range namedAnnotations(annotations, prefix) {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid index %q in %v annotations", name, prefix)
+		}
+		res[n] = conf
+	}
+	return res, nil
+}
+
+// sortedIndexes returns the keys of m in ascending order.
+func sortedIndexes(m map[int]map[string]string) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// splitList splits a comma separated annotation value, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// parseSize parses sizes like 512M, 20G or 20GiB in powers of 1024,
+// a plain number is in bytes.
+func parseSize(s string) (uint64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	shift := 0
+	if value != "" {
+		if i := strings.IndexByte("KMGTP", value[len(value)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n<<shift>>shift != n {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,262 @@
+package hvf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"containerd-hvf/pkg/iso9660"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// cloudInitSeedFileName is the NoCloud seed generated in the bundle.
+const cloudInitSeedFileName = "cidata.iso"
+
+// cloudInitLabel is the volume label cloud-init looks for.
+const cloudInitLabel = "cidata"
+
+// cloudConfig is the #cloud-config the shim passes as vendor-data, which
+// cloud-init merges below the user-data of the image.
+type cloudConfig struct {
+	Mounts       [][]string      `yaml:"mounts,omitempty"`
+	Growpart     *growpartConfig `yaml:"growpart,omitempty"`
+	ResizeRootfs bool            `yaml:"resize_rootfs,omitempty"`
+	WriteFiles   []writeFile     `yaml:"write_files,omitempty"`
+	Runcmd       [][]string      `yaml:"runcmd,omitempty"`
+}
+
+type writeFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+type growpartConfig struct {
+	Mode    string   `yaml:"mode"`
+	Devices []string `yaml:"devices"`
+}
+
+func (c *cloudConfig) empty() bool {
+	return len(c.Mounts) == 0 && c.Growpart == nil && !c.ResizeRootfs && len(c.WriteFiles) == 0 && len(c.Runcmd) == 0
+}
+
+// setupCloudInit writes a NoCloud seed to the bundle when the shim has
+// files to add to the one shipped with the image, e.g. a network-config
+// generated from annotations. The image seed is used as is otherwise. The
+// generated vendor-data is merged with the one of the image.
+func (v *VM) setupCloudInit() error {
+	generated := make(map[string][]byte)
+	networkConfig, err := renderNetworkConfig(v.config.Interfaces)
+	if err != nil {
+		return errors.Wrap(err, "failed to render network-config")
+	}
+	if networkConfig != nil {
+		generated["network-config"] = networkConfig
+	}
+	vendorConfig := &cloudConfig{
+		Mounts: sharedDirMounts(v.config.SharedDirs),
+	}
+	if v.config.GrowRoot {
+		vendorConfig.Growpart = &growpartConfig{Mode: "auto", Devices: []string{"/"}}
+		vendorConfig.ResizeRootfs = true
+	}
+	if v.config.Agent.Enabled {
+		agent, err := os.ReadFile(agentBinaryPath)
+		if err != nil {
+			return err
+		}
+		generated[agentFileName] = agent
+		agentCloudConfig(vendorConfig)
+	}
+	if !vendorConfig.empty() {
+		vendorData, err := marshalYAML(vendorConfig)
+		if err != nil {
+			return errors.Wrap(err, "failed to render vendor-data")
+		}
+		generated["vendor-data"] = append([]byte("#cloud-config\n"), vendorData...)
+	}
+	if len(generated) == 0 {
+		return nil
+	}
+	if v.config.Identity.SeedURL != "" {
+		names := make([]string, 0, len(generated))
+		for name := range generated {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "%v can't be used along annotations generating %v", AnnotationCloudInitSeed, strings.Join(names, ", "))
+	}
+
+	imageSeed := filepath.Join(v.bundle, "rootfs", defaultRootImagePath, defaultCloudInitImageFileName)
+	files, err := iso9660.ReadFiles(imageSeed)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read cloud-init seed %v", imageSeed)
+	}
+	if image, ok := files["vendor-data"]; ok && generated["vendor-data"] != nil {
+		merged, err := mergeVendorData(image, generated["vendor-data"])
+		if err != nil {
+			return errors.Wrapf(err, "failed to merge vendor-data with the one of %v", imageSeed)
+		}
+		generated["vendor-data"] = merged
+	}
+	for name, data := range generated {
+		if _, ok := files[name]; ok && name != "vendor-data" {
+			logrus.WithField("file", name).Info("overriding cloud-init file of the image")
+		}
+		files[name] = data
+	}
+
+	seed := filepath.Join(v.bundle, cloudInitSeedFileName)
+	f, err := os.OpenFile(seed, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := iso9660.Write(f, cloudInitLabel, files); err != nil {
+		return errors.Wrapf(err, "failed to write cloud-init seed %v", seed)
+	}
+	v.config.CloudInitImage = seed
+	return nil
+}
+
+// vendorDataTypes are the MIME types cloud-init gives user and vendor data,
+// by their first line. Longer prefixes come first.
+var vendorDataTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config-archive", "text/cloud-config-archive"},
+	{"#cloud-config-jsonp", "text/cloud-config-jsonp"},
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#part-handler", "text/part-handler"},
+	{"#include-once", "text/x-include-once-url"},
+	{"#include", "text/x-include-url"},
+	{"## template: jinja", "text/jinja2"},
+	{"#!", "text/x-shellscript"},
+}
+
+// mergeVendorData combines the vendor-data of the image with the generated
+// #cloud-config as a multipart MIME message. The lists of the generated
+// config, like runcmd or mounts, are appended to the ones of the image.
+func mergeVendorData(image, generated []byte) ([]byte, error) {
+	parts, err := vendorDataParts(image)
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/cloud-config")
+	header.Set("Merge-Type", "list(append)+dict(no_replace,recurse_list)+str()")
+	parts = append(parts, mimePart{header: header, data: generated})
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, part := range parts {
+		pw, err := w.CreatePart(part.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(part.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "Content-Type: multipart/mixed; boundary=%q\r\nMIME-Version: 1.0\r\n\r\n", w.Boundary())
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+type mimePart struct {
+	header textproto.MIMEHeader
+	data   []byte
+}
+
+// vendorDataParts splits vendor-data into MIME parts: the parts of a MIME
+// message, or the whole data typed by its first line.
+func vendorDataParts(data []byte) ([]mimePart, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	first := strings.ToLower(string(data[:bytes.IndexByte(append(data, '\n'), '\n')]))
+	if strings.HasPrefix(first, "content-type:") || strings.HasPrefix(first, "mime-version:") {
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				return nil, err
+			}
+			header := textproto.MIMEHeader(msg.Header)
+			delete(header, "Mime-Version")
+			return []mimePart{{header: header, data: body}}, nil
+		}
+		var parts []mimePart
+		r := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			body, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, mimePart{header: part.Header, data: body})
+		}
+	}
+	for _, t := range vendorDataTypes {
+		if strings.HasPrefix(first, t.prefix) {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", t.contentType)
+			return []mimePart{{header: header, data: data}}, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrInvalidImage, "unknown vendor-data format %q", first)
+}
+
+func marshalYAML(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+package hvf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestMergeVendorData(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	_, _ = gw.Write([]byte("#!/bin/sh\necho image\n"))
+	_ = gw.Close()
+	generated := []byte("#cloud-config\nruncmd:\n  - [hvf-agent]\n")
+
+	tests := []struct {
+		name  string
+		image []byte
+		types []string
+	}{
+		{
+			name:  "cloud-config",
+			image: []byte("#cloud-config\nruncmd:\n  - [echo, image]\n"),
+			types: []string{"text/cloud-config", "text/cloud-config"},
+		},
+		{
+			name:  "shell script",
+			image: []byte("#!/bin/sh\necho image\n"),
+			types: []string{"text/x-shellscript", "text/cloud-config"},
+		},
+		{
+			name:  "gzip",
+			image: gzipped.Bytes(),
+			types: []string{"text/x-shellscript", "text/cloud-config"},
+		},
+		{
+			name: "multipart",
+			image: []byte("Content-Type: multipart/mixed; boundary=\"b\"\r\nMIME-Version: 1.0\r\n\r\n" +
+				"--b\r\nContent-Type: text/x-shellscript\r\n\r\n#!/bin/sh\r\n" +
+				"--b\r\nContent-Type: text/cloud-boothook\r\n\r\n#cloud-boothook\r\n" +
+				"--b--\r\n"),
+			types: []string{"text/x-shellscript", "text/cloud-boothook", "text/cloud-config"},
+		},
+		{
+			name:  "empty",
+			image: []byte("\n"),
+			types: []string{"text/cloud-config"},
+		},
+	}
+	for _, tt := range tests {
+		merged, err := mergeVendorData(tt.image, generated)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		types, last, err := readMultipart(merged)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%v: got parts %v, expected %v", tt.name, types, tt.types)
+		}
+		if !bytes.Equal(last, generated) {
+			t.Errorf("%v: got generated part %q", tt.name, last)
+		}
+	}
+
+	if _, err := mergeVendorData([]byte("not cloud-init"), generated); err == nil {
+		t.Error("merged vendor-data of an unknown format")
+	}
+}
+
+// readMultipart returns the types of the parts of a MIME message, and the
+// data of the last one.
+func readMultipart(data []byte) ([]string, []byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var types []string
+	var last []byte
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			return types, last, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		types = append(types, part.Header.Get("Content-Type"))
+		if last, err = io.ReadAll(part); err != nil {
+			return nil, nil, err
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package hvf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"containerd-hvf/pkg/oci"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Labels set on committed images.
+const (
+	LabelCommitSource      = annotationPrefix + "commit.source"
+	LabelCommitVirtualSize = annotationPrefix + "commit.virtual-size"
+)
+
+// Commit flattens the root disk of the stopped VM into a compressed qcow2
+// and writes it, along with the cloud-init seed of its image, as an OCI
+// image layout tarball at output, laid out like the images setupRootFS
+// boots.
+func (v *VM) Commit(ctx context.Context, ref, output string, labels map[string]string) (ocispec.Descriptor, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid reference %q: %v", ref, err)
+	}
+	tag := "latest"
+	if tagged, ok := named.(docker.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if !filepath.IsAbs(output) {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrInvalidArgument, "output %q is not absolute", output)
+	}
+	// Keep the VM stopped while its disk is read.
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err = v.checkState("commit", StateCreated, StateStopped)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(output), ".hvf-commit-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.RemoveAll(tmp)
+	disk := filepath.Join(tmp, defaultRootImageFileName)
+	if err := flattenImage(v.config.RootImage, v.config.RootFormat, disk); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	info, err := getImageInfo(disk)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	imageLabels := map[string]string{
+		LabelCommitSource:      fmt.Sprintf("%v/%v", v.namespace, v.id),
+		LabelCommitVirtualSize: strconv.FormatUint(info.VirtualSize, 10),
+	}
+	for k, val := range labels {
+		imageLabels[k] = val
+	}
+	seed := filepath.Join(v.bundle, "rootfs", defaultRootImagePath, defaultCloudInitImageFileName)
+	desc, err := oci.WriteLayout(output, &oci.Image{
+		Name: named.String(),
+		Tag:  tag,
+		Files: []oci.File{
+			{Name: defaultRootImagePath + "/" + defaultRootImageFileName, Path: disk},
+			{Name: defaultRootImagePath + "/" + defaultCloudInitImageFileName, Path: seed},
+		},
+		Labels:       imageLabels,
+		Created:      time.Now(),
+		CreatedBy:    fmt.Sprintf("commit of %v/%v", v.namespace, v.id),
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to write %v", output)
+	}
+	logrus.WithFields(logrus.Fields{"ref": named.String(), "output": output, "digest": desc.Digest}).Info("committed VM")
+	return desc, nil
+}
+
+// flattenImage copies image and its backing chain into a single compressed
+// qcow2 at path. Internal snapshots are not copied.
+func flattenImage(image, format, path string) error {
+	cmd := exec.Command("qemu-img", "convert", "-c", "-f", format, "-O", "qcow2", image, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to flatten %v: %s", image, out))
+	}
+	return nil
+}
@@ -1,18 +1,157 @@
 package hvf
 
 import (
+	"fmt"
 	"path/filepath"
+	"strconv"
 
-	"github.com/google/uuid"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"libvirt.org/go/libvirtxml"
 )
 
-func RenderDomain(id, bundle string) *libvirtxml.Domain {
+// DomainConfig holds the per-container settings parsed from the OCI spec.
+type DomainConfig struct {
+	Interfaces []NetworkInterface
+	SharedDirs []SharedDir
+	Volumes    []Volume
+	// CloudInitImage overrides the NoCloud seed shipped with the image.
+	CloudInitImage string
+	// RootImage and RootFormat locate the boot disk, a qcow2 disk/boot.qcow2
+	// of the image by default.
+	RootImage  string
+	RootFormat string
+	// GrowRoot is set when the root disk is larger than the image and the
+	// guest should grow its root filesystem.
+	GrowRoot bool
+	// RootConvert converts non-qcow2 boot images to qcow2 before growing
+	// them.
+	RootConvert bool
+	// InstallImage is the installer ISO booted before the root disk, until
+	// the install is finished.
+	InstallImage string
+	// Kernel, Initrd and Cmdline boot a kernel of the image directly
+	// instead of the firmware, when Kernel is set.
+	Kernel   string
+	Initrd   string
+	Cmdline  string
+	Firmware FirmwareConfig
+	// TPM adds an emulated TPM 2.0.
+	TPM      bool
+	Guard    GuardConfig
+	Agent    AgentConfig
+	Graphics GraphicsConfig
+	Identity IdentityConfig
+	// Owner is the container owning the domain, set on Init.
+	Owner *DomainOwner
+	// ScreenshotOnTimeout saves the screen when the guest agent isn't
+	// ready in time after Start.
+	ScreenshotOnTimeout bool
+	// RootIOTune limits the I/O of the root disk, volumes having their own.
+	RootIOTune DiskIOTune
+	// IOTuneOverrides are the per-disk limits of annotations, by disk name.
+	IOTuneOverrides map[string]DiskIOTune
+}
+
+// NewDomainConfig parses the annotations of spec into a DomainConfig.
+func NewDomainConfig(ns, id string, spec *specs.Spec) (*DomainConfig, error) {
+	interfaces, err := parseNetworkInterfaces(ns, id, spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	sharedDirs, err := parseSharedDirs(spec)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := parseVolumes(spec)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseIOTuneOverrides(spec.Annotations, volumes)
+	if err != nil {
+		return nil, err
+	}
+	firmware, err := parseFirmware(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	var rootConvert bool
+	if value, ok := spec.Annotations[AnnotationRootConvert]; ok {
+		rootConvert, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q", AnnotationRootConvert, value)
+		}
+	}
+	var tpm bool
+	if value, ok := spec.Annotations[AnnotationTPM]; ok {
+		tpm, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q", AnnotationTPM, value)
+		}
+	}
+	guard, err := parseGuard(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	agent, err := parseAgent(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	graphics, err := parseGraphics(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := parseIdentity(ns, id, spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	// The agent is installed from the seed ISO, which a seed URL replaces.
+	if identity.SeedURL != "" && agent.Enabled {
+		return nil, fmt.Errorf("%v can't be used with %v", AnnotationCloudInitSeed, AnnotationAgent)
+	}
+	var screenshotOnTimeout bool
+	if value, ok := spec.Annotations[AnnotationScreenshotOnTimeout]; ok {
+		screenshotOnTimeout, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q", AnnotationScreenshotOnTimeout, value)
+		}
+		// Only the agent tells when the guest is ready.
+		if screenshotOnTimeout && !agent.Enabled {
+			return nil, fmt.Errorf("%v needs %v", AnnotationScreenshotOnTimeout, AnnotationAgent)
+		}
+	}
+	return &DomainConfig{
+		Interfaces:          interfaces,
+		SharedDirs:          sharedDirs,
+		Volumes:             volumes,
+		IOTuneOverrides:     overrides,
+		RootConvert:         rootConvert,
+		Firmware:            firmware,
+		TPM:                 tpm,
+		Guard:               guard,
+		Agent:               agent,
+		Graphics:            graphics,
+		Identity:            identity,
+		ScreenshotOnTimeout: screenshotOnTimeout,
+	}, nil
+}
+
+func RenderDomain(id, bundle string, config *DomainConfig) *libvirtxml.Domain {
+	cloudInitImage := config.CloudInitImage
+	if cloudInitImage == "" {
+		cloudInitImage = filepath.Join(bundle, "rootfs", defaultRootImagePath, defaultCloudInitImageFileName)
+	}
+	rootImage, rootFormat := config.RootImage, config.RootFormat
+	if rootImage == "" {
+		rootImage = filepath.Join(bundle, "rootfs", defaultRootImagePath, defaultRootImageFileName)
+	}
+	if rootFormat == "" {
+		rootFormat = "qcow2"
+	}
 	dom := libvirtxml.Domain{
 		// This type is required to use macOS hypervisor framework
 		Type: "hvf",
-		Name: id,
-		UUID: uuid.New().String(),
+		Name: DomainName(config.Identity.Namespace, id),
+		UUID: config.Identity.UUID(),
 		Memory: &libvirtxml.DomainMemory{
 			Value: 2,
 			Unit:  "GiB",
@@ -68,7 +207,7 @@ func RenderDomain(id, bundle string) *libvirtxml.Domain {
 					},
 					Source: &libvirtxml.DomainDiskSource{
 						File: &libvirtxml.DomainDiskSourceFile{
-							File: filepath.Join(bundle, "rootfs", defaultRootImagePath, defaultCloudInitImageFileName),
+							File: cloudInitImage,
 						},
 					},
 					Target:   &libvirtxml.DomainDiskTarget{Dev: "vda", Bus: "sata"},
@@ -81,14 +220,15 @@ func RenderDomain(id, bundle string) *libvirtxml.Domain {
 					Device: "disk",
 					Driver: &libvirtxml.DomainDiskDriver{
 						Name: "qemu",
-						Type: "qcow2",
+						Type: rootFormat,
 					},
 					Source: &libvirtxml.DomainDiskSource{
 						File: &libvirtxml.DomainDiskSourceFile{
-							File: filepath.Join(bundle, "rootfs", defaultRootImagePath, defaultRootImageFileName),
+							File: rootImage,
 						},
 					},
 					Target: &libvirtxml.DomainDiskTarget{Dev: "vdb", Bus: "virtio"},
+					IOTune: config.RootIOTune.libvirt(),
 				},
 			},
 			Inputs: []libvirtxml.DomainInput{
@@ -112,21 +252,6 @@ func RenderDomain(id, bundle string) *libvirtxml.Domain {
 					},
 				},
 			},
-			Graphics: []libvirtxml.DomainGraphic{
-				{
-					VNC: &libvirtxml.DomainGraphicVNC{
-						AutoPort: "yes",
-						Listen:   "0.0.0.0",
-						Listeners: []libvirtxml.DomainGraphicListener{
-							{
-								Address: &libvirtxml.DomainGraphicListenerAddress{
-									Address: "0.0.0.0",
-								},
-							},
-						},
-					},
-				},
-			},
 			Videos: []libvirtxml.DomainVideo{
 				{
 					Model: libvirtxml.DomainVideoModel{
@@ -140,16 +265,18 @@ func RenderDomain(id, bundle string) *libvirtxml.Domain {
 				Model: "virtio",
 			},
 		},
-		// Automatic tap interface setup is not supported on macOS,
-		// use vmNet API from HVF instead.
-		QEMUCommandline: &libvirtxml.DomainQEMUCommandline{
-			Args: []libvirtxml.DomainQEMUCommandlineArg{
-				{Value: "-netdev"},
-				{Value: "vmnet-shared,id=net0"},
-				{Value: "-device"},
-				{Value: "virtio-net-device,netdev=net0"},
-			},
-		},
 	}
+	renderOwner(&dom, config.Owner)
+	renderIdentity(&dom, config.Identity)
+	renderNetworkInterfaces(&dom, config.Interfaces)
+	renderSharedDirs(&dom, config.SharedDirs)
+	renderVolumes(&dom, config.Volumes)
+	renderInstall(&dom, config.InstallImage)
+	renderKernel(&dom, config)
+	renderFirmware(&dom, config.Firmware)
+	renderTPM(&dom, config.TPM)
+	renderGuard(&dom, config.Guard)
+	renderAgent(&dom, config.Agent)
+	renderGraphics(&dom, config.Graphics)
 	return &dom
 }
@@ -1,6 +1,7 @@
 package hvf
 
 import (
+	"containerd-hvf/pkg/api"
 	"github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/runtime"
@@ -30,6 +31,10 @@ func GetTopic(e interface{}) string {
 		return runtime.TaskResumedEventTopic
 	case *events.TaskCheckpointed:
 		return runtime.TaskCheckpointedEventTopic
+	case *api.WatchdogFired:
+		return TopicWatchdog
+	case *api.GuestPanicked:
+		return TopicPanic
 	default:
 		log.L.Warnf("no topic for type %#v", e)
 	}
@@ -0,0 +1,365 @@
+package hvf
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"containerd-hvf/pkg/api"
+	"github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/fifo"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// execReadSize is the most output read from the agent at once.
+const execReadSize = 32 << 10
+
+// execProcess is a process run in the guest by the agent. Its stdio fifos
+// are fed by polling the agent.
+type execProcess struct {
+	id    string
+	spec  *specs.Process
+	stdio stdio.Stdio
+
+	// mu guards the fields set by StartExec.
+	mu       sync.Mutex
+	pid      uint32
+	starting bool
+	started  bool
+	stdin    io.ReadWriteCloser
+
+	// exitStatus and exitedAt are set before done is closed.
+	done       chan struct{}
+	exitStatus uint32
+	exitedAt   time.Time
+}
+
+// state returns the pid of the process and whether it was started.
+func (p *execProcess) state() (uint32, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pid, p.started
+}
+
+// Exited tells whether the process exited.
+func (p *execProcess) Exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// AddExec registers a process to run in the guest by StartExec.
+func (v *VM) AddExec(id string, spec *specs.Process, stdio stdio.Stdio) error {
+	if !v.config.Agent.Enabled {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "exec requires the guest agent, set %v=true", AnnotationAgent)
+	}
+	if spec == nil || len(spec.Args) == 0 {
+		return errors.Wrap(errdefs.ErrInvalidArgument, "no command to exec")
+	}
+	if spec.Terminal || stdio.Terminal {
+		return errors.Wrap(errdefs.ErrNotImplemented, "exec with a terminal is not supported")
+	}
+	if err := v.checkState("exec in", StateRunning, StatePaused); err != nil {
+		return err
+	}
+	v.execMu.Lock()
+	defer v.execMu.Unlock()
+	if _, ok := v.execs[id]; ok {
+		return errors.Wrapf(errdefs.ErrAlreadyExists, "exec %v", id)
+	}
+	v.execs[id] = &execProcess{id: id, spec: spec, stdio: stdio, done: make(chan struct{})}
+	return nil
+}
+
+// GetExec returns a process added by AddExec.
+func (v *VM) GetExec(id string) (*execProcess, error) {
+	v.execMu.Lock()
+	defer v.execMu.Unlock()
+	p, ok := v.execs[id]
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "exec %v", id)
+	}
+	return p, nil
+}
+
+// StartExec starts a process in the guest, once the agent is ready.
+func (v *VM) StartExec(ctx context.Context, id string) (uint32, error) {
+	p, err := v.GetExec(id)
+	if err != nil {
+		return 0, err
+	}
+	if err := v.checkRunning(); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	if p.started || p.starting {
+		p.mu.Unlock()
+		return 0, errors.Wrapf(errdefs.ErrFailedPrecondition, "exec %v already started", id)
+	}
+	p.starting = true
+	p.mu.Unlock()
+	pid, err := v.startExec(ctx, p)
+	p.mu.Lock()
+	p.starting = false
+	p.mu.Unlock()
+	return pid, err
+}
+
+func (v *VM) startExec(ctx context.Context, p *execProcess) (uint32, error) {
+	id := p.id
+	client, err := v.waitAgent(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The client opened the fifos before asking for the exec, opening them
+	// doesn't block.
+	var stdout, stderr io.WriteCloser = nopWriteCloser{io.Discard}, nopWriteCloser{io.Discard}
+	if p.stdio.Stdout != "" {
+		stdout, err = fifo.OpenFifo(ctx, p.stdio.Stdout, syscall.O_WRONLY, 0)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to open stdout")
+		}
+	}
+	if p.stdio.Stderr != "" {
+		stderr, err = fifo.OpenFifo(ctx, p.stdio.Stderr, syscall.O_WRONLY, 0)
+		if err != nil {
+			stdout.Close()
+			return 0, errors.Wrap(err, "failed to open stderr")
+		}
+	}
+	var stdin io.ReadWriteCloser
+	if p.stdio.Stdin != "" {
+		stdin, err = fifo.OpenFifo(ctx, p.stdio.Stdin, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			stdout.Close()
+			stderr.Close()
+			return 0, errors.Wrap(err, "failed to open stdin")
+		}
+	}
+
+	resp, err := client.ExecProcess(ctx, &api.ExecProcessRequest{
+		ExecId: id,
+		Args:   p.spec.Args,
+		Env:    p.spec.Env,
+		Cwd:    p.spec.Cwd,
+		Uid:    p.spec.User.UID,
+		Gid:    p.spec.User.GID,
+		Stdin:  stdin != nil,
+	})
+	if err != nil {
+		for _, c := range []io.Closer{stdout, stderr, stdin} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		return 0, errors.Wrapf(errdefs.FromGRPC(err), "failed to exec %v", id)
+	}
+	pid := resp.Pid
+	p.mu.Lock()
+	p.pid, p.started, p.stdin = pid, true, stdin
+	p.mu.Unlock()
+
+	// The process outlives the request, don't tie its I/O to it.
+	ioCtx := context.Background()
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		copyFromAgent(ioCtx, id, stdout, client.ReadStdout)
+	}()
+	go func() {
+		defer output.Done()
+		copyFromAgent(ioCtx, id, stderr, client.ReadStderr)
+	}()
+	if stdin != nil {
+		go copyToAgent(ioCtx, id, stdin, client)
+	}
+	go func() {
+		resp, err := client.WaitProcess(ioCtx, &api.WaitProcessRequest{ExecId: id})
+		output.Wait()
+		if err != nil {
+			logrus.WithError(err).WithField("exec", id).Error("failed to wait for exec")
+			p.exitStatus, p.exitedAt = 255, time.Now()
+		} else {
+			p.exitStatus, p.exitedAt = resp.ExitStatus, resp.ExitedAt.AsTime()
+		}
+		close(p.done)
+		v.publish(&events.TaskExit{
+			ContainerID: v.id,
+			ID:          id,
+			Pid:         pid,
+			ExitStatus:  p.exitStatus,
+			ExitedAt:    timestamppb.New(p.exitedAt),
+		})
+	}()
+	return pid, nil
+}
+
+func copyFromAgent(ctx context.Context, id string, w io.WriteCloser, read func(context.Context, *api.ReadStreamRequest) (*api.ReadStreamResponse, error)) {
+	defer w.Close()
+	for {
+		resp, err := read(ctx, &api.ReadStreamRequest{ExecId: id, Len: execReadSize})
+		if err != nil {
+			logrus.WithError(err).WithField("exec", id).Error("failed to read exec output")
+			return
+		}
+		if len(resp.Data) > 0 {
+			if _, err := w.Write(resp.Data); err != nil {
+				logrus.WithError(err).WithField("exec", id).Warn("failed to forward exec output")
+				// Keep draining so that the process doesn't block.
+				w = nopWriteCloser{io.Discard}
+			}
+		}
+		if resp.Eof {
+			return
+		}
+	}
+}
+
+func copyToAgent(ctx context.Context, id string, r io.Reader, client api.AgentService) {
+	buf := make([]byte, execReadSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := client.WriteStdin(ctx, &api.WriteStreamRequest{ExecId: id, Data: buf[:n]}); err != nil {
+				logrus.WithError(err).WithField("exec", id).Warn("failed to forward exec input")
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if _, err := client.CloseStdin(ctx, &api.CloseStdinRequest{ExecId: id}); err != nil {
+		logrus.WithError(err).WithField("exec", id).Warn("failed to close exec input")
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// WaitExec waits for a process to exit and returns its exit status.
+func (v *VM) WaitExec(ctx context.Context, id string) (uint32, time.Time, error) {
+	p, err := v.GetExec(id)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	select {
+	case <-p.done:
+		return p.exitStatus, p.exitedAt, nil
+	case <-ctx.Done():
+		return 0, time.Time{}, ctx.Err()
+	}
+}
+
+// KillExec signals a process.
+func (v *VM) KillExec(ctx context.Context, id string, signal syscall.Signal) error {
+	p, err := v.GetExec(id)
+	if err != nil {
+		return err
+	}
+	if _, started := p.state(); !started || p.Exited() {
+		return errors.Wrapf(errdefs.ErrNotFound, "exec %v is not running", id)
+	}
+	client, err := v.agentClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.SignalProcess(ctx, &api.SignalProcessRequest{ExecId: id, Signal: uint32(signal)})
+	return errdefs.FromGRPC(err)
+}
+
+// CloseExecStdin closes the input of a process.
+func (v *VM) CloseExecStdin(id string) error {
+	p, err := v.GetExec(id)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin != nil {
+		// copyToAgent stops reading and closes the stdin of the process.
+		return stdin.Close()
+	}
+	return nil
+}
+
+// DeleteExec forgets a process that exited or never started.
+func (v *VM) DeleteExec(ctx context.Context, id string) (*execProcess, error) {
+	p, err := v.GetExec(id)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	starting, started := p.starting, p.started
+	p.mu.Unlock()
+	if starting {
+		return nil, errors.Wrapf(errdefs.ErrFailedPrecondition, "exec %v is starting", id)
+	}
+	if started {
+		if !p.Exited() {
+			return nil, errors.Wrapf(errdefs.ErrFailedPrecondition, "exec %v is running", id)
+		}
+		client, err := v.agentClient()
+		if err == nil {
+			_, err = client.RemoveProcess(ctx, &api.RemoveProcessRequest{ExecId: id})
+		}
+		if err != nil && !errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+			logrus.WithError(err).WithField("exec", id).Warn("failed to remove exec from agent")
+		}
+	}
+	v.execMu.Lock()
+	delete(v.execs, id)
+	v.execMu.Unlock()
+	return p, nil
+}
+
+// Processes lists the processes of the guest.
+func (v *VM) Processes(ctx context.Context) ([]*api.GuestProcess, error) {
+	if err := v.checkRunning(); err != nil {
+		return nil, err
+	}
+	client, err := v.agentClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.ListProcesses(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrap(errdefs.FromGRPC(err), "failed to list guest processes")
+	}
+	return resp.Processes, nil
+}
+
+// Stats returns the resource usage of the guest.
+func (v *VM) Stats(ctx context.Context) (*api.GuestStats, error) {
+	if err := v.checkRunning(); err != nil {
+		return nil, err
+	}
+	client, err := v.agentClient()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := client.GetStats(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrap(errdefs.FromGRPC(err), "failed to get guest stats")
+	}
+	return stats, nil
+}
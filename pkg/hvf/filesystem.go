@@ -0,0 +1,131 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Drivers sharing host directories with the guest.
+const (
+	FilesystemDriverVirtiofs = "virtiofs"
+	FilesystemDriver9p       = "9p"
+)
+
+// SharedDir is a host directory exposed to the guest and mounted at Target.
+type SharedDir struct {
+	Source   string
+	Target   string
+	Tag      string
+	ReadOnly bool
+	Driver   string
+}
+
+// parseSharedDirs maps the bind mounts of spec to shared directories.
+// Mounts of other types, like the /proc or /dev ones containerd adds by
+// default, make no sense for a VM and are ignored.
+func parseSharedDirs(spec *specs.Spec) ([]SharedDir, error) {
+	driver := spec.Annotations[AnnotationFilesystemDriver]
+	switch driver {
+	case "":
+		driver = defaultFilesystemDriver()
+	case FilesystemDriverVirtiofs, FilesystemDriver9p:
+	default:
+		return nil, fmt.Errorf("unsupported filesystem driver %q", driver)
+	}
+	var dirs []SharedDir
+	for _, m := range spec.Mounts {
+		if !isBindMount(m) {
+			continue
+		}
+		if !filepath.IsAbs(m.Destination) {
+			return nil, fmt.Errorf("mount destination %q is not absolute", m.Destination)
+		}
+		stat, err := os.Stat(m.Source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount source %q: %w", m.Source, err)
+		}
+		if !stat.IsDir() {
+			// e.g. /etc/hosts or /etc/resolv.conf added by CRI, only
+			// directories can be shared.
+			logrus.WithField("mount", m).Warn("ignoring bind mount of a non-directory")
+			continue
+		}
+		dirs = append(dirs, SharedDir{
+			Source:   m.Source,
+			Target:   m.Destination,
+			Tag:      fmt.Sprintf("hvfs%v", len(dirs)),
+			ReadOnly: hasOption(m.Options, "ro"),
+			Driver:   driver,
+		})
+	}
+	return dirs, nil
+}
+
+// defaultFilesystemDriver prefers virtiofs when virtiofsd is available.
+func defaultFilesystemDriver() string {
+	if _, err := exec.LookPath("virtiofsd"); err == nil {
+		return FilesystemDriverVirtiofs
+	}
+	return FilesystemDriver9p
+}
+
+func isBindMount(m specs.Mount) bool {
+	return m.Type == "bind" || hasOption(m.Options, "bind") || hasOption(m.Options, "rbind")
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func renderSharedDirs(dom *libvirtxml.Domain, dirs []SharedDir) {
+	for _, dir := range dirs {
+		fs := libvirtxml.DomainFilesystem{
+			Source: &libvirtxml.DomainFilesystemSource{
+				Mount: &libvirtxml.DomainFilesystemSourceMount{Dir: dir.Source},
+			},
+			Target: &libvirtxml.DomainFilesystemTarget{Dir: dir.Tag},
+		}
+		if dir.ReadOnly {
+			fs.ReadOnly = &libvirtxml.DomainFilesystemReadOnly{}
+		}
+		if dir.Driver == FilesystemDriverVirtiofs {
+			fs.Driver = &libvirtxml.DomainFilesystemDriver{Type: "virtiofs"}
+			// vhost-user requires the guest memory to be shared with virtiofsd,
+			// file backed as memfd is Linux only.
+			dom.MemoryBacking = &libvirtxml.DomainMemoryBacking{
+				MemorySource: &libvirtxml.DomainMemorySource{Type: "file"},
+				MemoryAccess: &libvirtxml.DomainMemoryAccess{Mode: "shared"},
+			}
+		} else {
+			fs.AccessMode = "passthrough"
+		}
+		dom.Devices.Filesystems = append(dom.Devices.Filesystems, fs)
+	}
+}
+
+// sharedDirMounts returns the cloud-init mounts entries for dirs.
+func sharedDirMounts(dirs []SharedDir) [][]string {
+	var mounts [][]string
+	for _, dir := range dirs {
+		options := "nofail"
+		if dir.Driver == FilesystemDriver9p {
+			options += ",trans=virtio,version=9p2000.L,msize=262144"
+		}
+		if dir.ReadOnly {
+			options += ",ro"
+		}
+		mounts = append(mounts, []string{dir.Tag, dir.Target, dir.Driver, options, "0", "0"})
+	}
+	return mounts
+}
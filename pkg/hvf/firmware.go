@@ -0,0 +1,119 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirtxml"
+)
+
+// nvramFileName is the NVRAM of the VM in the bundle, unless a persistent
+// one is named.
+const nvramFileName = "nvram.fd"
+
+// persistentNVRAMDir keeps the named NVRAMs, which outlive containers.
+const persistentNVRAMDir = "/var/lib/containerd-hvf/nvram"
+
+// FirmwareConfig selects the UEFI firmware and where its variables live.
+type FirmwareConfig struct {
+	// Loader is the firmware code, libvirt picks one matching the other
+	// settings when empty.
+	Loader string
+	// Vars is the template NVRAM is created from, e.g. one with enrolled
+	// Secure Boot keys.
+	Vars       string
+	SecureBoot bool
+	// NVRAMName names a persistent NVRAM, NVRAM being in the bundle otherwise.
+	NVRAMName string
+	// ResetNVRAM recreates NVRAM from the template when the VM is defined.
+	ResetNVRAM bool
+	// NVRAM is the path of the NVRAM of the VM.
+	NVRAM string
+}
+
+func parseFirmware(annotations map[string]string) (FirmwareConfig, error) {
+	conf := FirmwareConfig{
+		Loader:    annotations[AnnotationFirmwareLoader],
+		Vars:      annotations[AnnotationFirmwareVars],
+		NVRAMName: annotations[AnnotationNVRAMName],
+	}
+	if conf.Loader != "" && conf.Vars == "" {
+		return conf, fmt.Errorf("%v requires %v", AnnotationFirmwareLoader, AnnotationFirmwareVars)
+	}
+	if conf.NVRAMName != "" && !validDiskName.MatchString(conf.NVRAMName) {
+		return conf, fmt.Errorf("invalid NVRAM name %q", conf.NVRAMName)
+	}
+	for key, dst := range map[string]*bool{
+		AnnotationFirmwareSecureBoot: &conf.SecureBoot,
+		AnnotationNVRAMReset:         &conf.ResetNVRAM,
+	} {
+		if value, ok := annotations[key]; ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return conf, fmt.Errorf("invalid %v %q", key, value)
+			}
+			*dst = b
+		}
+	}
+	return conf, nil
+}
+
+// setupFirmware checks the firmware files and locates the NVRAM, which is
+// removed on reset for libvirt to create it from the template again.
+// Kernels booted directly need neither.
+func (v *VM) setupFirmware() error {
+	conf := &v.config.Firmware
+	if v.config.Kernel != "" {
+		return nil
+	}
+	for _, path := range []string{conf.Loader, conf.Vars} {
+		if path == "" {
+			continue
+		}
+		if err := checkBootFile(path); err != nil {
+			return errors.Wrap(err, "invalid firmware")
+		}
+	}
+	conf.NVRAM = filepath.Join(v.bundle, nvramFileName)
+	if conf.NVRAMName != "" {
+		if err := os.MkdirAll(persistentNVRAMDir, 0755); err != nil {
+			return err
+		}
+		conf.NVRAM = filepath.Join(persistentNVRAMDir, conf.NVRAMName+".fd")
+	}
+	if conf.ResetNVRAM {
+		logrus.WithField("nvram", conf.NVRAM).Info("resetting NVRAM")
+		if err := os.Remove(conf.NVRAM); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderFirmware(dom *libvirtxml.Domain, conf FirmwareConfig) {
+	if dom.OS.Kernel != "" {
+		return
+	}
+	dom.OS.NVRam = &libvirtxml.DomainNVRam{NVRam: conf.NVRAM, Template: conf.Vars}
+	if conf.Loader != "" {
+		// Manual firmware selection excludes the automatic one.
+		dom.OS.Firmware = ""
+		dom.OS.Loader = &libvirtxml.DomainLoader{Path: conf.Loader, Readonly: "yes", Type: "pflash"}
+		if conf.SecureBoot {
+			dom.OS.Loader.Secure = "yes"
+		}
+		return
+	}
+	if conf.SecureBoot {
+		dom.OS.FirmwareInfo = &libvirtxml.DomainOSFirmwareInfo{
+			Features: []libvirtxml.DomainOSFirmwareFeature{
+				{Name: "secure-boot", Enabled: "yes"},
+				{Name: "enrolled-keys", Enabled: "yes"},
+			},
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package hvf
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Graphics of the VM.
+const (
+	GraphicsNone  = "none"
+	GraphicsVNC   = "vnc"
+	GraphicsSpice = "spice"
+)
+
+// GraphicsListenUnix listens on a Unix socket instead of an address.
+const GraphicsListenUnix = "unix"
+
+// graphicsFileName records the endpoint and password of the display in the
+// bundle.
+const graphicsFileName = "graphics.json"
+
+// vncPasswordLength is the most VNC authentication supports.
+const vncPasswordLength = 8
+
+const spicePasswordLength = 16
+
+// GraphicsConfig selects the remote display of the VM.
+type GraphicsConfig struct {
+	Type string
+	// Listen is an address, loopback by default, or GraphicsListenUnix.
+	Listen   string
+	Socket   string
+	Password string
+}
+
+// GraphicsEndpoint is the content of graphics.json.
+type GraphicsEndpoint struct {
+	Type     string `json:"type"`
+	Address  string `json:"address,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Socket   string `json:"socket,omitempty"`
+	Password string `json:"password"`
+}
+
+func parseGraphics(annotations map[string]string) (GraphicsConfig, error) {
+	conf := GraphicsConfig{Type: GraphicsNone, Listen: "127.0.0.1"}
+	if value, ok := annotations[AnnotationGraphics]; ok {
+		switch value {
+		case GraphicsNone, GraphicsVNC, GraphicsSpice:
+			conf.Type = value
+		default:
+			return conf, fmt.Errorf("invalid %v %q, expect none, vnc or spice", AnnotationGraphics, value)
+		}
+	}
+	if value, ok := annotations[AnnotationGraphicsListen]; ok {
+		if value != GraphicsListenUnix && net.ParseIP(value) == nil {
+			return conf, fmt.Errorf("invalid %v %q, expect an IP address or unix", AnnotationGraphicsListen, value)
+		}
+		conf.Listen = value
+	}
+	return conf, nil
+}
+
+// setupGraphics generates the display password and records how to reach
+// the display.
+func (v *VM) setupGraphics() error {
+	conf := &v.config.Graphics
+	if conf.Type == GraphicsNone {
+		return nil
+	}
+	if ip := net.ParseIP(conf.Listen); ip != nil && !ip.IsLoopback() {
+		logrus.WithField("listen", conf.Listen).Warn("the display of the VM is reachable from the network")
+	}
+	if conf.Listen == GraphicsListenUnix {
+		socket, err := v.socketPath(conf.Type)
+		if err != nil {
+			return err
+		}
+		conf.Socket = socket
+	}
+	length := vncPasswordLength
+	if conf.Type == GraphicsSpice {
+		length = spicePasswordLength
+	}
+	password, err := generatePassword(length)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate display password")
+	}
+	conf.Password = password
+	return v.saveGraphics(0)
+}
+
+func generatePassword(length int) (string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// saveGraphics writes graphics.json, readable by root only as it holds the
+// password. The port is only known once the VM is started.
+func (v *VM) saveGraphics(port int) error {
+	conf := v.config.Graphics
+	endpoint := GraphicsEndpoint{Type: conf.Type, Socket: conf.Socket, Password: conf.Password}
+	if conf.Socket == "" {
+		endpoint.Address, endpoint.Port = conf.Listen, port
+	}
+	data, err := json.MarshalIndent(endpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(v.bundle, graphicsFileName)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// recordGraphicsPort records the port libvirt picked for the display of
+// the started VM.
+func (v *VM) recordGraphicsPort() error {
+	conf := v.config.Graphics
+	if conf.Type == GraphicsNone || conf.Socket != "" {
+		return nil
+	}
+	xmlString, err := v.client.DomainGetXMLDesc(v.domainMeta, 0)
+	if err != nil {
+		return err
+	}
+	dom := &libvirtxml.Domain{}
+	if err := dom.Unmarshal(xmlString); err != nil {
+		return err
+	}
+	for _, graphic := range dom.Devices.Graphics {
+		switch {
+		case graphic.VNC != nil && conf.Type == GraphicsVNC:
+			return v.saveGraphics(graphic.VNC.Port)
+		case graphic.Spice != nil && conf.Type == GraphicsSpice:
+			return v.saveGraphics(graphic.Spice.Port)
+		}
+	}
+	return errors.Errorf("no %v display", conf.Type)
+}
+
+// renderGraphics adds the display, none by default. The video device is
+// kept either way.
+func renderGraphics(dom *libvirtxml.Domain, conf GraphicsConfig) {
+	var listener libvirtxml.DomainGraphicListener
+	var listen string
+	if conf.Socket != "" {
+		listener.Socket = &libvirtxml.DomainGraphicListenerSocket{Socket: conf.Socket}
+	} else {
+		listen = conf.Listen
+		listener.Address = &libvirtxml.DomainGraphicListenerAddress{Address: conf.Listen}
+	}
+	switch conf.Type {
+	case GraphicsVNC:
+		vnc := &libvirtxml.DomainGraphicVNC{
+			Passwd:    conf.Password,
+			Listen:    listen,
+			Listeners: []libvirtxml.DomainGraphicListener{listener},
+		}
+		if conf.Socket == "" {
+			vnc.AutoPort = "yes"
+		}
+		dom.Devices.Graphics = []libvirtxml.DomainGraphic{{VNC: vnc}}
+	case GraphicsSpice:
+		spice := &libvirtxml.DomainGraphicSpice{
+			Passwd:    conf.Password,
+			Listen:    listen,
+			Listeners: []libvirtxml.DomainGraphicListener{listener},
+		}
+		if conf.Socket == "" {
+			spice.AutoPort = "yes"
+		}
+		dom.Devices.Graphics = []libvirtxml.DomainGraphic{{Spice: spice}}
+	default:
+		dom.Devices.Graphics = nil
+	}
+}
+
+// removeGraphics removes the socket libvirt leaves behind.
+func (v *VM) removeGraphics() error {
+	if v.config.Graphics.Socket == "" {
+		return nil
+	}
+	err := os.Remove(v.config.Graphics.Socket)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
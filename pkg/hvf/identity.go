@@ -0,0 +1,147 @@
+package hvf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"libvirt.org/go/libvirtxml"
+)
+
+// domainUUIDSpace is the namespace of domain UUIDs, derived from the
+// containerd namespace and container ID.
+var domainUUIDSpace = uuid.MustParse("b1018647-f2a0-4957-ad59-5896cc7eb1ad")
+
+// maxDomainNameLength keeps the paths libvirt and QEMU derive from domain
+// names, like the monitor socket, short.
+const maxDomainNameLength = 64
+
+// fwCfgPrefix is where the identity is found in the guest, under
+// /sys/firmware/qemu_fw_cfg/by_name.
+const fwCfgPrefix = "opt/io.containerd.hvf/"
+
+// IdentityConfig is what the guest is told about its container.
+type IdentityConfig struct {
+	Namespace string
+	ID        string
+	// Labels are the annotations passed to the guest, by key.
+	Labels map[string]string
+	// SeedURL is the NoCloud seed cloud-init fetches, as told by the SMBIOS
+	// serial or the kernel command line, instead of reading the seed ISO.
+	SeedURL string
+}
+
+// UUID is stable across restarts of the container.
+func (c IdentityConfig) UUID() string {
+	return uuid.NewSHA1(domainUUIDSpace, []byte(c.Namespace+"/"+c.ID)).String()
+}
+
+// DomainName is the libvirt domain name of a container, unique across
+// namespaces. It is <namespace>_<id>, unless the namespace has an underscore
+// making it ambiguous or it is too long, in which case it is cut and
+// suffixed with a hash of both.
+func DomainName(ns, id string) string {
+	name := sanitizeDomainName(ns) + "_" + sanitizeDomainName(id)
+	if name == ns+"_"+id && !strings.Contains(ns, "_") && len(name) <= maxDomainNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(ns + "/" + id))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if len(name) > maxDomainNameLength-len(suffix) {
+		name = name[:maxDomainNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+// sanitizeDomainName keeps the characters safe in file names, libvirt
+// rejecting slashes and QEMU splitting options on commas.
+func sanitizeDomainName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+func parseIdentity(ns, id string, annotations map[string]string) (IdentityConfig, error) {
+	conf := IdentityConfig{Namespace: ns, ID: id, Labels: make(map[string]string)}
+	for _, key := range splitList(annotations[AnnotationIdentityLabels]) {
+		if value, ok := annotations[key]; ok {
+			conf.Labels[key] = value
+		}
+	}
+	if value, ok := annotations[AnnotationCloudInitSeed]; ok {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") || strings.ContainsAny(value, "; \t\n") {
+			return conf, fmt.Errorf("invalid %v %q, expect a http, https or file URL", AnnotationCloudInitSeed, value)
+		}
+		// cloud-init appends the file names to the URL.
+		if !strings.HasSuffix(value, "/") {
+			value += "/"
+		}
+		conf.SeedURL = value
+	}
+	return conf, nil
+}
+
+// renderIdentity sets the SMBIOS system info, OEM strings and fw_cfg entries
+// naming the container, and drops the seed ISO when cloud-init gets its seed
+// from SMBIOS. SMBIOS tables are only built by the firmware, kernels booted
+// directly are told by their command line instead.
+func renderIdentity(dom *libvirtxml.Domain, conf IdentityConfig) {
+	serial := conf.Namespace + "/" + conf.ID
+	if conf.SeedURL != "" {
+		serial = "ds=nocloud;s=" + conf.SeedURL
+		disks := dom.Devices.Disks[:0]
+		for _, disk := range dom.Devices.Disks {
+			if disk.Device == "cdrom" && disk.Target.Dev == "vda" {
+				continue
+			}
+			disks = append(disks, disk)
+		}
+		dom.Devices.Disks = disks
+	}
+	oemStrings := []string{
+		"io.containerd.namespace=" + conf.Namespace,
+		"io.containerd.container.id=" + conf.ID,
+	}
+	keys := make([]string, 0, len(conf.Labels))
+	for key := range conf.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := &strings.Builder{}
+	for _, key := range keys {
+		oemStrings = append(oemStrings, key+"="+conf.Labels[key])
+		fmt.Fprintf(labels, "%v=%v\n", key, conf.Labels[key])
+	}
+	fwCfg := []libvirtxml.DomainSysInfoEntry{
+		{Name: fwCfgPrefix + "namespace", Value: conf.Namespace},
+		{Name: fwCfgPrefix + "id", Value: conf.ID},
+	}
+	if labels.Len() > 0 {
+		fwCfg = append(fwCfg, libvirtxml.DomainSysInfoEntry{Name: fwCfgPrefix + "labels", Value: labels.String()})
+	}
+
+	dom.OS.SMBios = &libvirtxml.DomainSMBios{Mode: "sysinfo"}
+	dom.SysInfo = append(dom.SysInfo,
+		libvirtxml.DomainSysInfo{SMBIOS: &libvirtxml.DomainSysInfoSMBIOS{
+			System: &libvirtxml.DomainSysInfoSystem{Entry: []libvirtxml.DomainSysInfoEntry{
+				{Name: "manufacturer", Value: "containerd-hvf"},
+				{Name: "product", Value: conf.ID},
+				{Name: "family", Value: conf.Namespace},
+				{Name: "serial", Value: serial},
+				{Name: "uuid", Value: dom.UUID},
+			}},
+			OEMStrings: &libvirtxml.DomainSysInfoOEMStrings{Entry: oemStrings},
+		}},
+		libvirtxml.DomainSysInfo{FWCfg: &libvirtxml.DomainSysInfoFWCfg{Entry: fwCfg}},
+	)
+}
@@ -0,0 +1,141 @@
+package hvf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// bootImageFileNames are looked up in order in the disk directory of images.
+var bootImageFileNames = []string{defaultRootImageFileName, "boot.raw", "boot.img", "boot.vmdk", "boot.vhdx"}
+
+// supportedImageFormats are the boot disk formats QEMU reads natively.
+var supportedImageFormats = []string{"qcow2", "raw", "vmdk", "vhdx"}
+
+// imageCacheDir keeps boot images converted to qcow2, by digest of the original.
+const imageCacheDir = "/var/lib/containerd-hvf/images"
+
+// digestIndexDir keeps the digests of images by file identity, so that
+// images aren't hashed again on every Create.
+const digestIndexDir = imageCacheDir + "/index"
+
+func findBootImage(imagePath string) (string, error) {
+	for _, name := range bootImageFileNames {
+		path := filepath.Join(imagePath, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Wrapf(ErrInvalidImage, "none of %v found in %v", strings.Join(bootImageFileNames, ", "), imagePath)
+}
+
+func checkImageFormat(path, format string) error {
+	for _, f := range supportedImageFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrInvalidImage, "%v is a %v image, supported formats are %v", path, format, strings.Join(supportedImageFormats, ", "))
+}
+
+// convertImage converts image to qcow2 once and returns the cached copy.
+// Copies are keyed by the digest of the image so that containers of the
+// same image share them.
+func convertImage(image, format string) (string, error) {
+	digest, err := cachedFileDigest(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to digest %v", image)
+	}
+	converted := filepath.Join(imageCacheDir, "sha256", digest+".qcow2")
+	if _, err := os.Stat(converted); err == nil {
+		return converted, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(converted), 0755); err != nil {
+		return "", err
+	}
+	// Convert to a temporary file first, so that concurrent conversions of
+	// the same image never expose a partial one.
+	tmp, err := os.CreateTemp(filepath.Dir(converted), digest+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+	logrus.WithFields(logrus.Fields{"image": image, "format": format, "to": converted}).Info("converting image to qcow2")
+	cmd := exec.Command("qemu-img", "convert", "-f", format, "-O", "qcow2", image, tmp.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to convert %v: %s", image, out))
+	}
+	if err := os.Rename(tmp.Name(), converted); err != nil {
+		return "", err
+	}
+	return converted, nil
+}
+
+// cachedFileDigest returns the digest of path, looked up by its device,
+// inode, size and modification time, which change when the file does.
+func cachedFileDigest(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileDigest(path)
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%v:%v:%v:%v", sys.Dev, sys.Ino, stat.Size(), stat.ModTime().UnixNano())))
+	index := filepath.Join(digestIndexDir, hex.EncodeToString(key[:]))
+	if data, err := os.ReadFile(index); err == nil && len(data) == sha256.Size*2 {
+		return string(data), nil
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+	// The index is only a shortcut, failing to write it is not an error.
+	if err := writeFileAtomic(index, []byte(digest)); err != nil {
+		logrus.WithError(err).WithField("image", path).Warn("failed to record image digest")
+	}
+	return digest, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
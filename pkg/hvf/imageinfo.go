@@ -0,0 +1,340 @@
+package hvf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// QemuImageInfo represents the struct returned from `qemu-img info`.
+type QemuImageInfo struct {
+	Path            string                   `json:"-"`
+	VirtualSize     uint64                   `json:"virtual-size"`
+	Format          string                   `json:"format"`
+	DirtyFlag       bool                     `json:"dirty-flag"`
+	ClusterSize     uint64                   `json:"cluster-size"`
+	BackingFilename string                   `json:"backing-filename"`
+	BackingFormat   string                   `json:"backing-filename-format"`
+	FormatSpecific  *QemuImageFormatSpecific `json:"format-specific"`
+	// ISO is set for raw images holding an ISO9660 filesystem.
+	ISO bool `json:"-"`
+}
+
+// QemuImageFormatSpecific holds the qcow2 specific part of `qemu-img info`.
+type QemuImageFormatSpecific struct {
+	Type string `json:"type"`
+	Data struct {
+		Compat          string `json:"compat"`
+		CompressionType string `json:"compression-type"`
+		Corrupt         bool   `json:"corrupt"`
+		DataFile        string `json:"data-file"`
+		Encrypted       bool   `json:"-"`
+		// Extents are the files holding the data of vmdk images.
+		Extents []struct {
+			Filename string `json:"filename"`
+		} `json:"extents"`
+	} `json:"data"`
+}
+
+// Corrupt reports whether a qcow2 image is marked corrupt.
+func (i *QemuImageInfo) Corrupt() bool {
+	return i.FormatSpecific != nil && i.FormatSpecific.Data.Corrupt
+}
+
+// Encrypted reports whether a qcow2 image uses the legacy AES encryption,
+// which QEMU refuses to boot.
+func (i *QemuImageInfo) Encrypted() bool {
+	return i.FormatSpecific != nil && i.FormatSpecific.Data.Encrypted
+}
+
+// DataFile returns the external data file of a qcow2 image, if any.
+func (i *QemuImageInfo) DataFile() string {
+	if i.FormatSpecific == nil {
+		return ""
+	}
+	return i.FormatSpecific.Data.DataFile
+}
+
+// Extents returns the files holding the data of a vmdk image.
+func (i *QemuImageInfo) Extents() []string {
+	if i.FormatSpecific == nil {
+		return nil
+	}
+	var extents []string
+	for _, extent := range i.FormatSpecific.Data.Extents {
+		extents = append(extents, extent.Filename)
+	}
+	return extents
+}
+
+// vmdkDescriptorMagic starts vmdk descriptor files, which name their
+// extents.
+var vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+
+// maxVMDKDescriptorSize bounds the descriptor files read, QEMU refusing
+// larger ones.
+const maxVMDKDescriptorSize = 1 << 20
+
+// vmdkExtentLine is an extent of a vmdk descriptor, e.g.
+// RW 4192256 FLAT "disk-flat.vmdk" 0.
+var vmdkExtentLine = regexp.MustCompile(`^(?:RW|RDONLY|NOACCESS)\s+\d+\s+\w+(?:\s+"([^"]*)")?`)
+
+// readVMDKExtents returns the extent files named by the vmdk descriptor
+// file at path, and false if path is not a descriptor file. They are read
+// without qemu-img, which opens them.
+func readVMDKExtents(path string) ([]string, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxVMDKDescriptorSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if !bytes.HasPrefix(data, vmdkDescriptorMagic) {
+		return nil, false, nil
+	}
+	if len(data) > maxVMDKDescriptorSize {
+		return nil, true, fmt.Errorf("vmdk descriptor %v is larger than %v bytes", path, maxVMDKDescriptorSize)
+	}
+	var extents []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := vmdkExtentLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil && m[1] != "" {
+			extents = append(extents, m[1])
+		}
+	}
+	return extents, true, nil
+}
+
+// getImageInfo reads qcow2 headers natively and tells raw and ISO images
+// apart from the other formats by their magic. Only formats like vmdk or
+// vhdx, whose headers are not parsed here, go through `qemu-img info`.
+func getImageInfo(path string) (*QemuImageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read header of %v", path)
+	}
+	header = header[:n]
+
+	var info *QemuImageInfo
+	switch {
+	case hasForeignMagic(header):
+		info, err = qemuImageInfo(path)
+	case bytes.HasPrefix(header, qcow2Magic):
+		info, err = readQcow2Info(f)
+	default:
+		info, err = readRawInfo(f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read image info of %v", path)
+	}
+	info.Path = path
+	return info, nil
+}
+
+// Magics of the formats qemu-img probes, besides qcow2 and raw.
+var foreignMagics = [][]byte{
+	[]byte("KDMV"),                                    // vmdk sparse extent
+	[]byte("# Disk DescriptorFile"),                   // vmdk descriptor
+	[]byte("vhdxfile"),                                // vhdx
+	[]byte("conectix"),                                // vpc
+	[]byte("<<< Oracle VM VirtualBox Disk Image >>>"), // vdi
+	[]byte("QED\x00"),                                 // qed
+	[]byte("LUKS\xba\xbe"),                            // luks
+	[]byte("QEVM"),                                    // parallels
+	[]byte("WithoutFreeSpace"),                        // parallels
+	[]byte("WithouFreSpacExt"),                        // parallels
+	[]byte("cloop"),                                   // cloop
+	[]byte("#!/bin/sh\n#V2.0 Format"),                 // cloop
+	[]byte("QFI\xfb\x00\x00\x00\x01"),                 // qcow version 1, same magic as qcow2
+}
+
+func hasForeignMagic(header []byte) bool {
+	for _, magic := range foreignMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func readRawInfo(f *os.File) (*QemuImageInfo, error) {
+	// Seek rather than stat to support block devices.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	info := &QemuImageInfo{Format: "raw", VirtualSize: uint64(size)}
+	// ISO9660 has its first volume descriptor at sector 16 of 2048 bytes.
+	magic := make([]byte, 5)
+	if _, err := f.ReadAt(magic, 16*2048+1); err == nil && string(magic) == "CD001" {
+		info.ISO = true
+	}
+	return info, nil
+}
+
+// qemuImageInfo runs `qemu-img info` for the formats not parsed natively.
+func qemuImageInfo(path string) (*QemuImageInfo, error) {
+	cmd := exec.Command("qemu-img", "info", "--output=json", path)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	res, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to run qemu-img info: %v", bytes.TrimSpace(stderr.Bytes())))
+	}
+	imageInfo := &QemuImageInfo{}
+	err = json.Unmarshal(res, imageInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read qemu-img info")
+	}
+
+	if imageInfo.Format == "" {
+		imageInfo.Format = "raw"
+	}
+
+	return imageInfo, nil
+}
+
+var qcow2Magic = []byte("QFI\xfb")
+
+// qcow2 header fields, see https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+const (
+	qcow2HeaderV2Length = 72
+	qcow2HeaderV3Length = 104
+
+	qcow2IncompatDirty        = 1 << 0
+	qcow2IncompatCorrupt      = 1 << 1
+	qcow2IncompatDataFile     = 1 << 2
+	qcow2IncompatCompression  = 1 << 3
+	qcow2IncompatExtendedL2   = 1 << 4
+	qcow2KnownIncompatFeature = qcow2IncompatDirty | qcow2IncompatCorrupt | qcow2IncompatDataFile |
+		qcow2IncompatCompression | qcow2IncompatExtendedL2
+
+	qcow2ExtensionEnd           = 0x00000000
+	qcow2ExtensionBackingFormat = 0xe2792aca
+	qcow2ExtensionDataFile      = 0x44415441
+
+	// qemu refuses backing file names longer than this.
+	qcow2MaxBackingFileSize = 1023
+	qcow2MaxClusterBits     = 21
+	qcow2MinClusterBits     = 9
+)
+
+func readQcow2Info(f *os.File) (*QemuImageInfo, error) {
+	header := make([]byte, qcow2HeaderV3Length+1)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header = header[:n]
+	if len(header) < qcow2HeaderV2Length {
+		return nil, fmt.Errorf("truncated qcow2 header")
+	}
+	be := binary.BigEndian
+	version := be.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %v", version)
+	}
+	clusterBits := be.Uint32(header[20:])
+	if clusterBits < qcow2MinClusterBits || clusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %v", clusterBits)
+	}
+	specific := &QemuImageFormatSpecific{Type: "qcow2"}
+	specific.Data.Compat = "0.10"
+	specific.Data.CompressionType = "zlib"
+	specific.Data.Encrypted = be.Uint32(header[32:]) != 0
+	info := &QemuImageInfo{
+		Format:         "qcow2",
+		VirtualSize:    be.Uint64(header[24:]),
+		ClusterSize:    1 << clusterBits,
+		FormatSpecific: specific,
+	}
+
+	headerLength := uint32(qcow2HeaderV2Length)
+	if version == 3 {
+		if len(header) < qcow2HeaderV3Length {
+			return nil, fmt.Errorf("truncated qcow2 v3 header")
+		}
+		specific.Data.Compat = "1.1"
+		incompatible := be.Uint64(header[72:])
+		if unknown := incompatible &^ qcow2KnownIncompatFeature; unknown != 0 {
+			return nil, fmt.Errorf("unsupported qcow2 incompatible features %#x", unknown)
+		}
+		info.DirtyFlag = incompatible&qcow2IncompatDirty != 0
+		specific.Data.Corrupt = incompatible&qcow2IncompatCorrupt != 0
+		headerLength = be.Uint32(header[100:])
+		if headerLength < qcow2HeaderV3Length {
+			return nil, fmt.Errorf("invalid qcow2 header length %v", headerLength)
+		}
+		if incompatible&qcow2IncompatCompression != 0 {
+			if headerLength <= qcow2HeaderV3Length || len(header) <= qcow2HeaderV3Length {
+				return nil, fmt.Errorf("qcow2 compression type is missing")
+			}
+			switch header[qcow2HeaderV3Length] {
+			case 0:
+			case 1:
+				specific.Data.CompressionType = "zstd"
+			default:
+				return nil, fmt.Errorf("unknown qcow2 compression type %v", header[qcow2HeaderV3Length])
+			}
+		}
+	}
+
+	backingOffset := be.Uint64(header[8:])
+	backingSize := be.Uint32(header[16:])
+	if backingOffset != 0 && backingSize != 0 {
+		if backingSize > qcow2MaxBackingFileSize {
+			return nil, fmt.Errorf("qcow2 backing file name is too long")
+		}
+		name := make([]byte, backingSize)
+		if _, err := f.ReadAt(name, int64(backingOffset)); err != nil {
+			return nil, errors.Wrap(err, "failed to read qcow2 backing file name")
+		}
+		info.BackingFilename = string(name)
+	}
+
+	// Header extensions follow the header, up to the end of the first cluster.
+	clusterSize := int64(info.ClusterSize)
+	for offset := int64(headerLength); offset+8 <= clusterSize; {
+		ext := make([]byte, 8)
+		if _, err := f.ReadAt(ext, offset); err != nil {
+			return nil, errors.Wrap(err, "failed to read qcow2 header extension")
+		}
+		typ, length := be.Uint32(ext), int64(be.Uint32(ext[4:]))
+		if typ == qcow2ExtensionEnd {
+			break
+		}
+		offset += 8
+		if offset+length > clusterSize {
+			return nil, fmt.Errorf("qcow2 header extension %#x overflows the first cluster", typ)
+		}
+		if typ == qcow2ExtensionBackingFormat || typ == qcow2ExtensionDataFile {
+			data := make([]byte, length)
+			if _, err := f.ReadAt(data, offset); err != nil {
+				return nil, errors.Wrap(err, "failed to read qcow2 header extension")
+			}
+			if typ == qcow2ExtensionBackingFormat {
+				info.BackingFormat = string(data)
+			} else {
+				specific.Data.DataFile = string(data)
+			}
+		}
+		offset += (length + 7) &^ 7
+	}
+	return info, nil
+}
@@ -0,0 +1,220 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirtxml"
+)
+
+// installImageFileName is the installer ISO images may ship instead of a
+// boot disk.
+const installImageFileName = "install.iso"
+
+// persistentDiskDir keeps the named root disks, which outlive containers.
+// It is a variable for tests.
+var persistentDiskDir = "/var/lib/containerd-hvf/disks"
+
+// defaultInstallSize is the size of blank disks when no install.size is given.
+const defaultInstallSize = "20G"
+
+// installTargetDev is the installer CD-ROM, next to the cloud-init one.
+const installTargetDev = "sda"
+
+var validDiskName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// setupInstall sets up the root disk in install mode, where the guest is
+// installed from an ISO into a blank disk, and for named persistent disks.
+// A persistent disk that exists already was installed by a previous
+// container and is booted as is. Persistent disks are locked until the
+// container is deleted, so that no two VMs boot or install the same disk.
+func (v *VM) setupInstall(iso, name string) error {
+	disk := filepath.Join(v.bundle, rootOverlayFileName)
+	if name != "" {
+		if !validDiskName.MatchString(name) {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid disk name %q", name)
+		}
+		if err := os.MkdirAll(persistentDiskDir, 0755); err != nil {
+			return err
+		}
+		if err := v.lockDisk(name); err != nil {
+			return err
+		}
+		disk = filepath.Join(persistentDiskDir, name+".qcow2")
+		if _, err := os.Stat(disk); err == nil {
+			info, err := getImageInfo(disk)
+			if err != nil {
+				return err
+			}
+			if iso != "" {
+				logrus.WithField("disk", disk).Info("persistent disk exists, skipping install")
+			}
+			v.config.RootImage = disk
+			v.config.RootFormat = info.Format
+			return nil
+		}
+		if iso == "" {
+			return errors.Wrapf(errdefs.ErrNotFound, "persistent disk %v doesn't exist and no installer is given", name)
+		}
+	}
+	info, err := getImageInfo(iso)
+	if err != nil {
+		return err
+	}
+	if !info.ISO {
+		return errors.Wrapf(ErrInvalidImage, "installer %v is not an ISO image", iso)
+	}
+	sizeValue := v.spec.Annotations[AnnotationInstallSize]
+	if sizeValue == "" {
+		sizeValue = defaultInstallSize
+	}
+	size, err := parseSize(sizeValue)
+	if err != nil {
+		return errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+	}
+	if err := createBlankDisk(disk, size); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"iso": iso, "disk": disk, "size": size}).Info("installing VM")
+	v.config.RootImage = disk
+	v.config.RootFormat = "qcow2"
+	v.config.InstallImage = iso
+	return nil
+}
+
+// lockDisk takes the lock of the persistent disk name, held by the shim
+// until unlockDisk.
+func (v *VM) lockDisk(name string) error {
+	path := filepath.Join(persistentDiskDir, name+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errors.Wrapf(errdefs.ErrUnavailable, "persistent disk %v is used by another container", name)
+		}
+		return errors.Wrapf(err, "failed to lock persistent disk %v", name)
+	}
+	v.mu.Lock()
+	v.diskLock = f
+	v.mu.Unlock()
+	return nil
+}
+
+// unlockDisk releases the lock of the persistent disk, if any.
+func (v *VM) unlockDisk() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.diskLock == nil {
+		return nil
+	}
+	// Closing the file releases the lock, which is left in place: removing
+	// it could let two containers lock different files for the same disk.
+	err := v.diskLock.Close()
+	v.diskLock = nil
+	return err
+}
+
+func createBlankDisk(path string, size uint64) error {
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", path, strconv.FormatUint(size, 10))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to create disk %v: %s", path, out))
+	}
+	return nil
+}
+
+// renderInstall boots the installer first and the root disk second.
+func renderInstall(dom *libvirtxml.Domain, iso string) {
+	if iso == "" {
+		return
+	}
+	// Per device boot order excludes the os one.
+	dom.OS.BootDevices = nil
+	for i := range dom.Devices.Disks {
+		if dom.Devices.Disks[i].Target.Dev == "vdb" {
+			dom.Devices.Disks[i].Boot = &libvirtxml.DomainDeviceBoot{Order: 2}
+		}
+	}
+	dom.Devices.Disks = append(dom.Devices.Disks, libvirtxml.DomainDisk{
+		Device: "cdrom",
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{File: iso},
+		},
+		Target:   &libvirtxml.DomainDiskTarget{Dev: installTargetDev, Bus: "sata"},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		Boot:     &libvirtxml.DomainDeviceBoot{Order: 1},
+	})
+}
+
+// poweredOffByGuest tells whether the guest shut itself down, rather than
+// being killed, or stopped by its watchdog or a panic.
+func (v *VM) poweredOffByGuest() bool {
+	if v.killed.Load() || v.ctx.Err() != nil || v.exitCode.Load() != 0 {
+		return false
+	}
+	state, reason, err := v.client.DomainGetState(v.domainMeta, 0)
+	return err == nil && state == int32(libvirt.DomainShutoff) && reason == int32(libvirt.DomainShutoffShutdown)
+}
+
+// finishInstall redefines the domain to boot from its disk, once the guest
+// powered off at the end of the installation.
+func (v *VM) finishInstall() error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.config.InstallImage == "" {
+		return nil
+	}
+	var disks []libvirtxml.DomainDisk
+	for _, disk := range v.domain.Devices.Disks {
+		if disk.Target.Dev == installTargetDev {
+			continue
+		}
+		disk.Boot = nil
+		disks = append(disks, disk)
+	}
+	v.domain.Devices.Disks = disks
+	v.domain.OS.BootDevices = []libvirtxml.DomainBootDevice{{Dev: "hd"}}
+	xmlString, err := v.domain.Marshal()
+	if err != nil {
+		return err
+	}
+	// The domain keeps its name and UUID, v.domainMeta still refers to it.
+	_, err = v.client.DomainDefineXML(xmlString)
+	if err != nil {
+		return errors.Wrapf(err, "failed to redefine VM '%v'", v.domain.Name)
+	}
+	v.config.InstallImage = ""
+	logrus.WithField("disk", v.config.RootImage).Info("install finished, booting from disk")
+	return nil
+}
+
+// removeUnfinishedInstall removes a persistent disk whose install never
+// finished, so that the next container installs it again.
+func (v *VM) removeUnfinishedInstall() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.config.InstallImage == "" || filepath.Dir(v.config.RootImage) != persistentDiskDir {
+		return nil
+	}
+	logrus.WithField("disk", v.config.RootImage).Warn("removing disk of unfinished install")
+	err := os.Remove(v.config.RootImage)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package hvf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+)
+
+// newInstallVM returns a stopped VM installing into a persistent disk.
+func newInstallVM(t *testing.T, fake *fakeLibvirt) *VM {
+	persistentDiskDir = t.TempDir()
+	v := newTestVM(t, fake)
+	v.state = StateStopped
+	v.config.InstallImage = filepath.Join(v.bundle, installImageFileName)
+	v.config.RootImage = filepath.Join(persistentDiskDir, "disk.qcow2")
+	if err := os.WriteFile(v.config.RootImage, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDeleteInstall(t *testing.T) {
+	defer func(dir string) { persistentDiskDir = dir }(persistentDiskDir)
+	tests := []struct {
+		name   string
+		reason libvirt.DomainShutoffReason
+		killed bool
+		kept   bool
+	}{
+		{name: "guest shut off, no Wait", reason: libvirt.DomainShutoffShutdown, kept: true},
+		{name: "killed", reason: libvirt.DomainShutoffShutdown, killed: true},
+		{name: "destroyed", reason: libvirt.DomainShutoffDestroyed},
+		{name: "crashed", reason: libvirt.DomainShutoffCrashed},
+	}
+	for _, tt := range tests {
+		fake := newFakeLibvirt(libvirt.DomainShutoff)
+		fake.reason = int32(tt.reason)
+		v := newInstallVM(t, fake)
+		v.killed.Store(tt.killed)
+		if _, err := v.Delete(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		_, err := os.Stat(v.config.RootImage)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%v: disk kept %v, expected %v", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestLockDisk(t *testing.T) {
+	defer func(dir string) { persistentDiskDir = dir }(persistentDiskDir)
+	persistentDiskDir = t.TempDir()
+	first := newTestVM(t, nil)
+	second := newTestVM(t, nil)
+	if err := first.lockDisk("disk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.lockDisk("disk"); !errdefs.IsUnavailable(err) {
+		t.Errorf("second lock: got %v, expected unavailable", err)
+	}
+	if err := first.unlockDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.lockDisk("disk"); err != nil {
+		t.Errorf("lock after unlock: %v", err)
+	}
+	if err := second.unlockDisk(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package hvf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"containerd-hvf/pkg/typed"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBackingChainDepth bounds the backing chain of boot images.
+const maxBackingChainDepth = 16
+
+// repairedImagePrefix names the per-container copies of repaired images.
+const repairedImagePrefix = "repaired-"
+
+// checkImageChain refuses dirty, corrupt or encrypted images in the backing
+// chain of image, and chains with files outside root, including external
+// data files and vmdk extents. Backing files are checked
+// before being opened, so that an image can't make the shim read arbitrary
+// host files. With repair set to "leaks" or "all", a damaged image is copied
+// to dir and the copy is repaired by `qemu-img check -r`, as the image is
+// shared by every container of its snapshot. Damaged backing files are
+// always refused. It returns the image to boot, image or its repaired copy.
+func checkImageChain(image, root, repair, dir string) (string, error) {
+	if repair != "" && repair != "leaks" && repair != "all" {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "repair mode %q is not one of leaks, all", repair)
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	boot := image
+	path := image
+	for depth := 0; ; depth++ {
+		if depth == maxBackingChainDepth {
+			return "", &typed.ImageIntegrityError{
+				Path:   image,
+				Reason: fmt.Sprintf("backing chain is deeper than %v", maxBackingChainDepth),
+				Err:    typed.ErrUnsafeBackingChain,
+			}
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", &typed.ImageIntegrityError{Path: path, Reason: err.Error(), Err: typed.ErrUnsafeBackingChain}
+		}
+		if !isWithin(resolved, root) {
+			return "", &typed.ImageIntegrityError{
+				Path:   path,
+				Reason: fmt.Sprintf("resolves to %v outside of %v", resolved, root),
+				Err:    typed.ErrUnsafeBackingChain,
+			}
+		}
+		// qemu-img opens the extents of vmdk descriptors, check them first.
+		extents, descriptor, err := readVMDKExtents(resolved)
+		if err != nil {
+			return "", err
+		}
+		for _, extent := range extents {
+			if err := checkReferencedFile(resolved, extent, "extent", root); err != nil {
+				return "", err
+			}
+		}
+		info, err := getImageInfo(resolved)
+		if err != nil {
+			return "", err
+		}
+		// Sparse vmdk images embed their descriptor.
+		if !descriptor {
+			for _, extent := range info.Extents() {
+				if err := checkReferencedFile(resolved, extent, "extent", root); err != nil {
+					return "", err
+				}
+			}
+		}
+		if info.Encrypted() {
+			return "", &typed.ImageIntegrityError{Path: resolved, Reason: "qcow2 encryption is not supported", Err: typed.ErrEncryptedImage}
+		}
+		if info.DirtyFlag || info.Corrupt() {
+			if repair == "" || depth > 0 {
+				return "", integrityError(resolved, info, depth > 0)
+			}
+			boot, err = repairImage(resolved, info, repair, dir)
+			if err != nil {
+				return "", err
+			}
+			repaired, err := getImageInfo(boot)
+			if err != nil {
+				return "", err
+			}
+			if repaired.DirtyFlag || repaired.Corrupt() {
+				return "", integrityError(resolved, repaired, false)
+			}
+		}
+		if dataFile := info.DataFile(); dataFile != "" {
+			if err := checkReferencedFile(resolved, dataFile, "external data file", root); err != nil {
+				return "", err
+			}
+		}
+		if info.BackingFilename == "" {
+			return boot, nil
+		}
+		if strings.Contains(info.BackingFilename, ":") && !filepath.IsAbs(info.BackingFilename) {
+			// Protocol prefixed backing files like nbd: or http: never point
+			// into the snapshot directory.
+			return "", &typed.ImageIntegrityError{
+				Path:   resolved,
+				Reason: fmt.Sprintf("backing file %q is not a local file", info.BackingFilename),
+				Err:    typed.ErrUnsafeBackingChain,
+			}
+		}
+		next := info.BackingFilename
+		if !filepath.IsAbs(next) {
+			next = filepath.Join(filepath.Dir(resolved), next)
+		}
+		path = next
+	}
+}
+
+// checkReferencedFile refuses a file image reads its data from, like an
+// external data file or a vmdk extent, outside of root.
+func checkReferencedFile(image, file, what, root string) error {
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(image), path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err != nil || !isWithin(resolved, root) {
+		return &typed.ImageIntegrityError{
+			Path:   image,
+			Reason: fmt.Sprintf("%v %q is outside of %v", what, file, root),
+			Err:    typed.ErrUnsafeBackingChain,
+		}
+	}
+	return nil
+}
+
+// integrityError tells how to repair a damaged image, backing files not
+// being repaired by the shim.
+func integrityError(path string, info *QemuImageInfo, backing bool) error {
+	hint := "repair it with `qemu-img check -r all` and push the image again"
+	if !backing {
+		hint += ", or set " + AnnotationImageRepair + " to boot a repaired copy"
+	}
+	if info.Corrupt() {
+		return &typed.ImageIntegrityError{Path: path, Reason: "marked corrupt, " + hint, Err: typed.ErrCorruptImage}
+	}
+	return &typed.ImageIntegrityError{Path: path, Reason: "not cleanly closed, " + hint, Err: typed.ErrDirtyImage}
+}
+
+// repairImage repairs a copy of image in dir and returns the copy, keeping
+// its backing file.
+func repairImage(image string, info *QemuImageInfo, mode, dir string) (string, error) {
+	repaired := filepath.Join(dir, repairedImagePrefix+filepath.Base(image))
+	logrus.WithFields(logrus.Fields{"image": image, "copy": repaired, "mode": mode}).Warn("repairing a copy of image")
+	if err := copyImage(image, repaired); err != nil {
+		return "", errors.Wrapf(err, "failed to copy %v", image)
+	}
+	if info.BackingFilename != "" && !filepath.IsAbs(info.BackingFilename) {
+		// Relative backing files are relative to the original.
+		backing := filepath.Join(filepath.Dir(image), info.BackingFilename)
+		args := []string{"rebase", "-u", "-f", info.Format, "-b", backing}
+		if info.BackingFormat != "" {
+			args = append(args, "-F", info.BackingFormat)
+		}
+		cmd := exec.Command("qemu-img", append(args, repaired)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", errors.Wrap(err, fmt.Sprintf("failed to rebase %v: %s", repaired, out))
+		}
+	}
+	cmd := exec.Command("qemu-img", "check", "-f", info.Format, "-r", mode, repaired)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to repair %v: %s", repaired, out))
+	}
+	return repaired, nil
+}
+
+func copyImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isWithin reports whether path is root or below it.
+func isWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
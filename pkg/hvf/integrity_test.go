@@ -0,0 +1,66 @@
+package hvf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"containerd-hvf/pkg/typed"
+)
+
+const testDescriptor = `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 4192256 FLAT %q 0
+RDONLY 2048 ZERO
+`
+
+func TestReadVMDKExtents(t *testing.T) {
+	dir := t.TempDir()
+	descriptor := filepath.Join(dir, "boot.vmdk")
+	if err := os.WriteFile(descriptor, []byte(fmt.Sprintf(testDescriptor, "boot-flat.vmdk")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	extents, ok, err := readVMDKExtents(descriptor)
+	if err != nil || !ok || !reflect.DeepEqual(extents, []string{"boot-flat.vmdk"}) {
+		t.Errorf("got %v, %v, %v, expected boot-flat.vmdk", extents, ok, err)
+	}
+
+	qcow2 := filepath.Join(dir, "boot.qcow2")
+	if err := os.WriteFile(qcow2, qcow2Magic, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := readVMDKExtents(qcow2); ok || err != nil {
+		t.Errorf("qcow2 image read as a vmdk descriptor: %v, %v", ok, err)
+	}
+}
+
+func TestCheckImageChainVMDKExtents(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.Symlink(secret, filepath.Join(root, "link-flat.vmdk")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extent := range []string{secret, "../" + filepath.Base(outside) + "/secret", "link-flat.vmdk", "missing-flat.vmdk"} {
+		descriptor := filepath.Join(root, "boot.vmdk")
+		if err := os.WriteFile(descriptor, []byte(fmt.Sprintf(testDescriptor, extent)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := checkImageChain(descriptor, root, "", root)
+		if !errors.Is(err, typed.ErrUnsafeBackingChain) {
+			t.Errorf("extent %v: got %v, expected an unsafe backing chain", extent, err)
+		}
+	}
+}
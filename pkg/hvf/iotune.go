@@ -0,0 +1,255 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"libvirt.org/go/libvirtxml"
+)
+
+// rootDiskName names the root disk in iotune annotations, volumes going by
+// their own names.
+const rootDiskName = "root"
+
+// DiskIOTune limits the I/O of a disk, zero meaning unlimited.
+type DiskIOTune struct {
+	TotalBytesSec uint64
+	ReadBytesSec  uint64
+	WriteBytesSec uint64
+	TotalIopsSec  uint64
+	ReadIopsSec   uint64
+	WriteIopsSec  uint64
+}
+
+// parseIOTuneOverrides reads the per-disk limits of the iotune annotations,
+// rates in bytes take sizes like 50M.
+func parseIOTuneOverrides(annotations map[string]string, volumes []Volume) (map[string]DiskIOTune, error) {
+	names := map[string]bool{rootDiskName: true}
+	for _, volume := range volumes {
+		names[volume.Name] = true
+	}
+	res := make(map[string]DiskIOTune)
+	for name, conf := range namedAnnotations(annotations, AnnotationIOTunePrefix) {
+		if !names[name] {
+			return nil, fmt.Errorf("iotune of unknown disk %q", name)
+		}
+		var tune DiskIOTune
+		for key, value := range conf {
+			var err error
+			switch key {
+			case "total_bytes_sec":
+				tune.TotalBytesSec, err = parseSize(value)
+			case "read_bytes_sec":
+				tune.ReadBytesSec, err = parseSize(value)
+			case "write_bytes_sec":
+				tune.WriteBytesSec, err = parseSize(value)
+			case "total_iops_sec":
+				tune.TotalIopsSec, err = strconv.ParseUint(value, 10, 64)
+			case "read_iops_sec":
+				tune.ReadIopsSec, err = strconv.ParseUint(value, 10, 64)
+			case "write_iops_sec":
+				tune.WriteIopsSec, err = strconv.ParseUint(value, 10, 64)
+			default:
+				return nil, fmt.Errorf("disk %v: unknown iotune key %q", name, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("disk %v: invalid %v %q", name, key, value)
+			}
+		}
+		res[name] = tune
+	}
+	return res, nil
+}
+
+// blockIOTune returns the throttle limits of blkio that apply to the host
+// device dev.
+func blockIOTune(blkio *specs.LinuxBlockIO, dev uint64) DiskIOTune {
+	var tune DiskIOTune
+	if blkio == nil {
+		return tune
+	}
+	rate := func(devices []specs.LinuxThrottleDevice) uint64 {
+		for _, d := range devices {
+			if uint32(d.Major) == unix.Major(dev) && uint32(d.Minor) == unix.Minor(dev) {
+				return d.Rate
+			}
+		}
+		return 0
+	}
+	tune.ReadBytesSec = rate(blkio.ThrottleReadBpsDevice)
+	tune.WriteBytesSec = rate(blkio.ThrottleWriteBpsDevice)
+	tune.ReadIopsSec = rate(blkio.ThrottleReadIOPSDevice)
+	tune.WriteIopsSec = rate(blkio.ThrottleWriteIOPSDevice)
+	return tune
+}
+
+// override replaces the limits of t set in o.
+func (t DiskIOTune) override(o DiskIOTune) DiskIOTune {
+	set := func(dst *uint64, v uint64) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	set(&t.TotalBytesSec, o.TotalBytesSec)
+	set(&t.ReadBytesSec, o.ReadBytesSec)
+	set(&t.WriteBytesSec, o.WriteBytesSec)
+	set(&t.TotalIopsSec, o.TotalIopsSec)
+	set(&t.ReadIopsSec, o.ReadIopsSec)
+	set(&t.WriteIopsSec, o.WriteIopsSec)
+	return t
+}
+
+func (t DiskIOTune) libvirt() *libvirtxml.DomainDiskIOTune {
+	if t == (DiskIOTune{}) {
+		return nil
+	}
+	return &libvirtxml.DomainDiskIOTune{
+		TotalBytesSec: t.TotalBytesSec,
+		ReadBytesSec:  t.ReadBytesSec,
+		WriteBytesSec: t.WriteBytesSec,
+		TotalIopsSec:  t.TotalIopsSec,
+		ReadIopsSec:   t.ReadIopsSec,
+		WriteIopsSec:  t.WriteIopsSec,
+	}
+}
+
+func (t DiskIOTune) params() []libvirt.TypedParam {
+	param := func(field string, v uint64) libvirt.TypedParam {
+		return libvirt.TypedParam{Field: field, Value: *libvirt.NewTypedParamValueUllong(v)}
+	}
+	return []libvirt.TypedParam{
+		param("total_bytes_sec", t.TotalBytesSec),
+		param("read_bytes_sec", t.ReadBytesSec),
+		param("write_bytes_sec", t.WriteBytesSec),
+		param("total_iops_sec", t.TotalIopsSec),
+		param("read_iops_sec", t.ReadIopsSec),
+		param("write_iops_sec", t.WriteIopsSec),
+	}
+}
+
+// hostDevice returns the device a disk lives on: the device itself for
+// block devices, the one of the filesystem holding the image otherwise.
+func hostDevice(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device of %v", path)
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		return uint64(stat.Rdev), nil
+	}
+	return uint64(stat.Dev), nil
+}
+
+// setupIOTune translates the blkio throttles of resources into limits of
+// the disks they live on, then applies the annotation overrides. Weights
+// would be libvirt <blkiotune>, which needs the blkio cgroup controller
+// macOS doesn't have, so they are ignored with a warning.
+func (v *VM) setupIOTune(resources *specs.LinuxResources) error {
+	var blkio *specs.LinuxBlockIO
+	if resources != nil {
+		blkio = resources.BlockIO
+	}
+	v.warnWeights(blkio)
+	tune := func(name, path string) (DiskIOTune, error) {
+		t := DiskIOTune{}
+		if blkio != nil {
+			dev, err := hostDevice(path)
+			if err != nil {
+				return t, errors.Wrapf(err, "disk %v", name)
+			}
+			t = blockIOTune(blkio, dev)
+		}
+		return t.override(v.config.IOTuneOverrides[name]), nil
+	}
+	var err error
+	v.config.RootIOTune, err = tune(rootDiskName, v.config.RootImage)
+	if err != nil {
+		return err
+	}
+	for i := range v.config.Volumes {
+		volume := &v.config.Volumes[i]
+		volume.IOTune, err = tune(volume.Name, volume.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnWeights warns about the blkio weights setupIOTune ignores.
+func (v *VM) warnWeights(blkio *specs.LinuxBlockIO) {
+	if blkio != nil && (blkio.Weight != nil || blkio.LeafWeight != nil || len(blkio.WeightDevice) > 0) {
+		logrus.WithField("id", v.id).Warn("ignoring blkio weights, HVF hosts have no blkio controller, use throttles")
+	}
+}
+
+// hasThrottles tells whether blkio limits any device.
+func hasThrottles(blkio *specs.LinuxBlockIO) bool {
+	return blkio != nil && (len(blkio.ThrottleReadBpsDevice) > 0 || len(blkio.ThrottleWriteBpsDevice) > 0 ||
+		len(blkio.ThrottleReadIOPSDevice) > 0 || len(blkio.ThrottleWriteIOPSDevice) > 0)
+}
+
+// UpdateIOTune applies the blkio throttles of resources to the disks, live
+// when the VM is running. Updates without blkio throttles keep the limits.
+func (v *VM) UpdateIOTune(resources *specs.LinuxResources) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkState("update", StateCreated, StateRunning, StatePaused, StateStopped)
+	if err != nil {
+		return err
+	}
+	if resources == nil || !hasThrottles(resources.BlockIO) {
+		if resources != nil {
+			v.warnWeights(resources.BlockIO)
+		}
+		return nil
+	}
+	v.mu.Lock()
+	err = v.setupIOTune(resources)
+	v.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainAffectConfig
+	if state := v.State(); state == StateRunning || state == StatePaused {
+		flags |= libvirt.DomainAffectLive
+	}
+	disks := map[string]DiskIOTune{v.config.RootImage: v.config.RootIOTune}
+	for _, volume := range v.config.Volumes {
+		disks[volume.Source] = volume.IOTune
+	}
+	for i := range v.domain.Devices.Disks {
+		disk := &v.domain.Devices.Disks[i]
+		source := ""
+		switch {
+		case disk.Source == nil:
+		case disk.Source.File != nil:
+			source = disk.Source.File.File
+		case disk.Source.Block != nil:
+			source = disk.Source.Block.Dev
+		}
+		t, ok := disks[source]
+		if !ok || disk.Device != "disk" {
+			continue
+		}
+		err := v.client.DomainSetBlockIOTune(v.domainMeta, disk.Target.Dev, t.params(), uint32(flags))
+		if err != nil {
+			return errors.Wrapf(err, "failed to set I/O limits of disk %v", disk.Target.Dev)
+		}
+		v.mu.Lock()
+		disk.IOTune = t.libvirt()
+		v.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package hvf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestBlkioWeightsIgnored(t *testing.T) {
+	fake := newFakeLibvirt(libvirt.DomainRunning)
+	v := newTestVM(t, fake)
+	v.config.RootImage = filepath.Join(v.bundle, defaultRootImageFileName)
+	if err := os.WriteFile(v.config.RootImage, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := hostDevice(v.config.RootImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight := uint16(500)
+	err = v.setupIOTune(&specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{
+		Weight: &weight,
+		ThrottleReadBpsDevice: []specs.LinuxThrottleDevice{{
+			LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: int64(unix.Major(dev)), Minor: int64(unix.Minor(dev))},
+			Rate:               1 << 20,
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.config.RootIOTune.ReadBytesSec != 1<<20 {
+		t.Errorf("root disk limited to %v bytes/s, expected the throttle to be kept", v.config.RootIOTune.ReadBytesSec)
+	}
+
+	// Updates with weights only keep the limits.
+	err = v.UpdateIOTune(&specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{Weight: &weight}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.config.RootIOTune.ReadBytesSec != 1<<20 || fake.ioTuneCalls() != 0 {
+		t.Errorf("update with weights changed the limits")
+	}
+}
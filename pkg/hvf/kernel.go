@@ -0,0 +1,86 @@
+package hvf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Files of images booting a kernel directly instead of through the firmware.
+const (
+	kernelFileName  = "vmlinuz"
+	initrdFileName  = "initrd"
+	cmdlineFileName = "cmdline"
+)
+
+// defaultKernelCmdline suits the layout of cloud images, the root disk being
+// the first virtio one.
+const defaultKernelCmdline = "console=ttyAMA0 root=/dev/vda1 rw"
+
+// setupKernel enables direct kernel boot when the image ships a kernel.
+// The initrd is optional, the command line comes from the annotation, then
+// from the image.
+func (v *VM) setupKernel(imagePath string) error {
+	cmdline, ok := v.spec.Annotations[AnnotationKernelCmdline]
+	kernel := filepath.Join(imagePath, kernelFileName)
+	if _, err := os.Stat(kernel); err != nil {
+		if os.IsNotExist(err) && !ok {
+			return nil
+		}
+		return errors.Wrapf(ErrInvalidImage, "direct kernel boot needs %v: %v", kernelFileName, err)
+	}
+	if err := checkBootFile(kernel); err != nil {
+		return err
+	}
+	linked := filepath.Join(v.bundle, "rootfs", defaultRootImagePath)
+	v.config.Kernel = filepath.Join(linked, kernelFileName)
+	initrd := filepath.Join(imagePath, initrdFileName)
+	if _, err := os.Stat(initrd); err == nil {
+		if err := checkBootFile(initrd); err != nil {
+			return err
+		}
+		v.config.Initrd = filepath.Join(linked, initrdFileName)
+	}
+	if !ok {
+		data, err := os.ReadFile(filepath.Join(imagePath, cmdlineFileName))
+		switch {
+		case err == nil:
+			cmdline = string(data)
+		case os.IsNotExist(err):
+			cmdline = defaultKernelCmdline
+		default:
+			return err
+		}
+	}
+	v.config.Cmdline = strings.TrimSpace(cmdline)
+	return nil
+}
+
+func checkBootFile(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return errors.Wrapf(ErrInvalidImage, "%v is not a regular non-empty file", path)
+	}
+	return nil
+}
+
+// renderKernel boots the kernel directly, skipping the firmware. Without
+// the firmware there is no SMBIOS, the seed URL goes on the command line.
+func renderKernel(dom *libvirtxml.Domain, config *DomainConfig) {
+	if config.Kernel == "" {
+		return
+	}
+	dom.OS.Firmware = ""
+	dom.OS.Kernel = config.Kernel
+	dom.OS.Initrd = config.Initrd
+	dom.OS.Cmdline = config.Cmdline
+	if config.Identity.SeedURL != "" {
+		dom.OS.Cmdline = strings.TrimSpace(dom.OS.Cmdline + " ds=nocloud;s=" + config.Identity.SeedURL)
+	}
+}
@@ -0,0 +1,35 @@
+package hvf
+
+import (
+	"context"
+	"io"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// libvirtClient is the part of libvirt a VM uses, implemented by
+// *libvirt.Libvirt.
+type libvirtClient interface {
+	DomainDefineXML(xml string) (libvirt.Domain, error)
+	DomainCreate(dom libvirt.Domain) error
+	DomainDestroy(dom libvirt.Domain) error
+	DomainUndefineFlags(dom libvirt.Domain, flags libvirt.DomainUndefineFlagsValues) error
+	DomainSuspend(dom libvirt.Domain) error
+	DomainResume(dom libvirt.Domain) error
+	DomainGetState(dom libvirt.Domain, flags uint32) (state int32, reason int32, err error)
+	DomainGetXMLDesc(dom libvirt.Domain, flags libvirt.DomainXMLFlags) (string, error)
+	DomainSetBlockIOTune(dom libvirt.Domain, disk string, params []libvirt.TypedParam, flags uint32) error
+	DomainScreenshot(dom libvirt.Domain, stream io.Writer, screen uint32, flags uint32) (libvirt.OptString, error)
+
+	DomainSnapshotCurrent(dom libvirt.Domain, flags uint32) (libvirt.DomainSnapshot, error)
+	DomainSnapshotCreateXML(dom libvirt.Domain, xml string, flags uint32) (libvirt.DomainSnapshot, error)
+	DomainSnapshotLookupByName(dom libvirt.Domain, name string, flags uint32) (libvirt.DomainSnapshot, error)
+	DomainRevertToSnapshot(snap libvirt.DomainSnapshot, flags uint32) error
+	DomainSnapshotDelete(snap libvirt.DomainSnapshot, flags libvirt.DomainSnapshotDeleteFlags) error
+	DomainListAllSnapshots(dom libvirt.Domain, needResults int32, flags uint32) ([]libvirt.DomainSnapshot, int32, error)
+
+	SubscribeEvents(ctx context.Context, eventID libvirt.DomainEventID, dom libvirt.OptDomain) (<-chan interface{}, error)
+	Disconnect() error
+}
+
+var _ libvirtClient = (*libvirt.Libvirt)(nil)
@@ -0,0 +1,154 @@
+package hvf
+
+import (
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// State is where a VM is in its lifecycle.
+type State string
+
+const (
+	StateCreated  State = "created"
+	StateRunning  State = "running"
+	StatePaused   State = "paused"
+	StateStopping State = "stopping"
+	StateStopped  State = "stopped"
+	StateDeleted  State = "deleted"
+)
+
+// transitions are the states each state can move to. A VM stops on its own,
+// or is killed, in any state but stopped and deleted.
+var transitions = map[State][]State{
+	StateCreated:  {StateRunning, StateStopped, StateDeleted},
+	StateRunning:  {StatePaused, StateStopping, StateStopped},
+	StatePaused:   {StateRunning, StateStopping, StateStopped},
+	StateStopping: {StateStopped},
+	StateStopped:  {StateDeleted},
+}
+
+// maxTransitions is how many transitions are kept for debugging.
+const maxTransitions = 32
+
+// Transition is a change of the lifecycle state of a VM.
+type Transition struct {
+	From   State
+	To     State
+	Reason string
+	At     time.Time
+}
+
+func canTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionError tells why the VM can't move to a state: it is gone once
+// deleted, otherwise in the wrong state.
+func (v *VM) transitionError(from, to State) error {
+	if from == StateDeleted {
+		return errors.Wrapf(errdefs.ErrNotFound, "VM %v is deleted", v.id)
+	}
+	return errors.Wrapf(errdefs.ErrFailedPrecondition, "VM %v is %v, can't move to %v", v.id, from, to)
+}
+
+// State returns the lifecycle state of the VM, as last seen.
+func (v *VM) State() State {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.state
+}
+
+// Transitions returns the latest lifecycle transitions, oldest first.
+func (v *VM) Transitions() []Transition {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]Transition(nil), v.transitions...)
+}
+
+// checkRunning fails right away when the VM isn't running, instead of
+// waiting for its agent.
+func (v *VM) checkRunning() error {
+	state := v.State()
+	switch state {
+	case StateRunning:
+		return nil
+	case StateDeleted:
+		return errors.Wrapf(errdefs.ErrNotFound, "VM %v is deleted", v.id)
+	default:
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "VM %v is %v, not running", v.id, state)
+	}
+}
+
+// checkState fails unless the VM is in one of states, for the operations
+// that don't change the state. Callers keeping it in that state hold opMu.
+func (v *VM) checkState(action string, states ...State) error {
+	state := v.State()
+	for _, s := range states {
+		if s == state {
+			return nil
+		}
+	}
+	if state == StateDeleted {
+		return errors.Wrapf(errdefs.ErrNotFound, "VM %v is deleted", v.id)
+	}
+	return errors.Wrapf(errdefs.ErrFailedPrecondition, "can't %v a %v VM", action, state)
+}
+
+// checkTransition returns an error if the VM can't move to state to.
+// Callers hold opMu until they transition.
+func (v *VM) checkTransition(to State) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !canTransition(v.state, to) {
+		return v.transitionError(v.state, to)
+	}
+	return nil
+}
+
+// transition moves the VM to state to.
+func (v *VM) transition(to State, reason string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.transitionLocked(to, reason)
+}
+
+// observe follows a state change made behind the shim, like the guest
+// powering off. The ones not allowed from the current state are logged and
+// ignored.
+func (v *VM) observe(to State, reason string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// The domain keeps running while the guest shuts down.
+	if v.state == to || (v.state == StateStopping && to == StateRunning) {
+		return
+	}
+	if err := v.transitionLocked(to, reason); err != nil {
+		logrus.WithError(err).WithField("reason", reason).Warn("ignoring VM state seen in libvirt")
+	}
+}
+
+func (v *VM) transitionLocked(to State, reason string) error {
+	from := v.state
+	if !canTransition(from, to) {
+		return v.transitionError(from, to)
+	}
+	now := time.Now()
+	v.state = to
+	if to == StateStopped {
+		v.exitedAt = now
+	}
+	v.transitions = append(v.transitions, Transition{From: from, To: to, Reason: reason, At: now})
+	if len(v.transitions) > maxTransitions {
+		v.transitions = v.transitions[len(v.transitions)-maxTransitions:]
+	}
+	logrus.WithFields(logrus.Fields{"from": from, "to": to, "reason": reason}).Info("VM lifecycle transition")
+	return nil
+}
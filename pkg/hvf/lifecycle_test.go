@@ -0,0 +1,148 @@
+package hvf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestLifecycleRequests(t *testing.T) {
+	ctx := context.Background()
+	failedPrecondition := func(t *testing.T, request string, err error) {
+		t.Helper()
+		if !errdefs.IsFailedPrecondition(errdefs.FromGRPC(err)) {
+			t.Errorf("%v: got %v, expected failed precondition", request, err)
+		}
+	}
+
+	t.Run("start twice", func(t *testing.T) {
+		v := newTestVM(t, newFakeLibvirt(libvirt.DomainShutoff))
+		v.state = StateCreated
+		v.config.Guard = GuardConfig{Watchdog: GuardActionNone, Panic: GuardActionNone}
+		v.config.Graphics.Type = GraphicsNone
+		s := newTestService(t, v)
+		if _, err := s.Start(ctx, &task.StartRequest{ID: v.ID()}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.Start(ctx, &task.StartRequest{ID: v.ID()})
+		failedPrecondition(t, "second start", err)
+	})
+
+	t.Run("delete running", func(t *testing.T) {
+		v := newTestVM(t, newFakeLibvirt(libvirt.DomainRunning))
+		s := newTestService(t, v)
+		_, err := s.Delete(ctx, &task.DeleteRequest{ID: v.ID()})
+		failedPrecondition(t, "delete", err)
+		if state := v.State(); state != StateRunning {
+			t.Errorf("VM is %v after a refused delete, expected running", state)
+		}
+	})
+
+	t.Run("resume stopping", func(t *testing.T) {
+		v := newTestVM(t, newFakeLibvirt(libvirt.DomainRunning))
+		v.state = StateStopping
+		s := newTestService(t, v)
+		_, err := s.Resume(ctx, &task.ResumeRequest{ID: v.ID()})
+		failedPrecondition(t, "resume", err)
+	})
+
+	t.Run("unknown ID", func(t *testing.T) {
+		s := newTestService(t, nil)
+		_, err := s.Kill(ctx, &task.KillRequest{ID: "missing", Signal: uint32(syscall.SIGKILL)})
+		if !errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+			t.Errorf("kill: got %v, expected not found", err)
+		}
+		_, err = s.State(ctx, &task.StateRequest{ID: "missing"})
+		if !errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+			t.Errorf("state: got %v, expected not found", err)
+		}
+	})
+}
+
+func TestTransitionsTruncated(t *testing.T) {
+	tests := []struct {
+		pauses   int
+		expected int
+	}{
+		{pauses: 1, expected: 2},
+		{pauses: maxTransitions / 2, expected: maxTransitions},
+		{pauses: maxTransitions, expected: maxTransitions},
+	}
+	for _, tt := range tests {
+		v := &VM{id: "test", state: StateRunning}
+		for i := 0; i < tt.pauses; i++ {
+			if err := v.transition(StatePaused, fmt.Sprintf("pause %v", i)); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.transition(StateRunning, fmt.Sprintf("resume %v", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		transitions := v.Transitions()
+		if len(transitions) != tt.expected {
+			t.Errorf("%v pauses: got %v transitions, expected %v", tt.pauses, len(transitions), tt.expected)
+			continue
+		}
+		// The latest are kept.
+		last := transitions[len(transitions)-1]
+		if reason := fmt.Sprintf("resume %v", tt.pauses-1); last.Reason != reason {
+			t.Errorf("%v pauses: latest transition is %q, expected %q", tt.pauses, last.Reason, reason)
+		}
+	}
+}
+
+func TestStateGating(t *testing.T) {
+	tests := []struct {
+		state    State
+		notFound bool
+		ok       bool
+	}{
+		{state: StateCreated, ok: true},
+		{state: StateRunning, ok: true},
+		{state: StatePaused, ok: true},
+		{state: StateStopping},
+		{state: StateStopped, ok: true},
+		{state: StateDeleted, notFound: true},
+	}
+	for _, tt := range tests {
+		fake := newFakeLibvirt(libvirt.DomainRunning)
+		v := newTestVM(t, fake)
+		v.state = tt.state
+		v.config.RootImage = filepath.Join(v.bundle, defaultRootImageFileName)
+		if err := os.WriteFile(v.config.RootImage, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		v.domain.Devices = &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{{
+			Device: "disk",
+			Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: v.config.RootImage}},
+			Target: &libvirtxml.DomainDiskTarget{Dev: "vda"},
+		}}}
+		err := v.UpdateIOTune(&specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{
+			ThrottleReadBpsDevice: []specs.LinuxThrottleDevice{{Rate: 1 << 20}},
+		}})
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("update of a %v VM: %v", tt.state, err)
+		case tt.notFound && !errdefs.IsNotFound(err):
+			t.Errorf("update of a %v VM: got %v, expected not found", tt.state, err)
+		case !tt.ok && !tt.notFound && !errdefs.IsFailedPrecondition(err):
+			t.Errorf("update of a %v VM: got %v, expected failed precondition", tt.state, err)
+		}
+		expected := 0
+		if tt.ok {
+			expected = 1
+		}
+		if calls := fake.ioTuneCalls(); calls != expected {
+			t.Errorf("update of a %v VM set I/O limits %v times, expected %v", tt.state, calls, expected)
+		}
+	}
+}
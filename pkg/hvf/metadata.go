@@ -0,0 +1,101 @@
+package hvf
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Version of the shim, set at build time.
+var Version = "dev"
+
+// OwnerNamespace is the XML namespace of the metadata telling the domains
+// defined by the shim apart.
+const OwnerNamespace = "https://github.com/ziyanli33/containerd-hvf/owner/v1"
+
+// annotationCRIImageName is the image of CRI containers.
+const annotationCRIImageName = "io.kubernetes.cri.image-name"
+
+// DomainOwner is the container a domain belongs to.
+type DomainOwner struct {
+	XMLName     xml.Name  `xml:"https://github.com/ziyanli33/containerd-hvf/owner/v1 owner"`
+	Namespace   string    `xml:"namespace"`
+	ContainerID string    `xml:"container-id"`
+	Bundle      string    `xml:"bundle"`
+	Image       string    `xml:"image,omitempty"`
+	ShimVersion string    `xml:"shim-version"`
+	CreatedAt   time.Time `xml:"created-at"`
+}
+
+func newDomainOwner(ns, id, bundle string, annotations map[string]string) *DomainOwner {
+	image := annotations[AnnotationImage]
+	if image == "" {
+		image = annotations[annotationCRIImageName]
+	}
+	return &DomainOwner{
+		Namespace:   ns,
+		ContainerID: id,
+		Bundle:      bundle,
+		Image:       image,
+		ShimVersion: Version,
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// renderOwner adds the owner metadata.
+func renderOwner(dom *libvirtxml.Domain, owner *DomainOwner) {
+	if owner == nil {
+		return
+	}
+	// Marshalling only fails on unsupported types.
+	data, _ := xml.Marshal(owner)
+	dom.Metadata = &libvirtxml.DomainMetadata{XML: string(data)}
+}
+
+// OwnedDomain is a domain defined by the shim.
+type OwnedDomain struct {
+	Name  string
+	Owner DomainOwner
+}
+
+// ListOwnedDomains returns the domains having owner metadata, leaving out
+// the ones defined by hand.
+func ListOwnedDomains(client *libvirt.Libvirt) ([]OwnedDomain, error) {
+	domains, _, err := client.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list domains")
+	}
+	var res []OwnedDomain
+	for _, dom := range domains {
+		data, err := client.DomainGetMetadata(dom, int32(libvirt.DomainMetadataElement), libvirt.OptString{OwnerNamespace}, 0)
+		if err != nil {
+			// No owner metadata.
+			continue
+		}
+		owned := OwnedDomain{Name: dom.Name}
+		if err := xml.Unmarshal([]byte(data), &owned.Owner); err != nil {
+			return nil, errors.Wrapf(err, "invalid owner metadata of domain %v", dom.Name)
+		}
+		res = append(res, owned)
+	}
+	return res, nil
+}
+
+// LookupOwnedDomain finds the domain of a container by its owner metadata,
+// which also covers domains named by earlier versions.
+func LookupOwnedDomain(client *libvirt.Libvirt, ns, id string) (*OwnedDomain, error) {
+	owned, err := ListOwnedDomains(client)
+	if err != nil {
+		return nil, err
+	}
+	for i := range owned {
+		if owned[i].Owner.Namespace == ns && owned[i].Owner.ContainerID == id {
+			return &owned[i], nil
+		}
+	}
+	return nil, errors.Wrapf(errdefs.ErrNotFound, "domain of container %v/%v", ns, id)
+}
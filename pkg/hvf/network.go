@@ -0,0 +1,277 @@
+package hvf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Network modes. The vmnet ones use the vmNet API from HVF through QEMU
+// directly as libvirt has no interface type for them on macOS, the others
+// are plain libvirt interface types.
+const (
+	NetworkModeVmnetShared  = "vmnet-shared"
+	NetworkModeVmnetHost    = "vmnet-host"
+	NetworkModeVmnetBridged = "vmnet-bridged"
+	NetworkModeUser         = "user"
+	NetworkModeNetwork      = "network"
+	NetworkModeBridge       = "bridge"
+)
+
+const defaultNetworkModel = "virtio"
+
+// NetworkInterface describes one NIC of the VM.
+type NetworkInterface struct {
+	Mode string
+	// Source is the libvirt network or bridge name, or the host interface
+	// for vmnet-bridged.
+	Source string
+	Model  string
+	MAC    string
+
+	// Static guest configuration, the guest uses DHCP when Addresses is empty.
+	Addresses   []string
+	Routes      []NetworkRoute
+	MTU         int
+	Nameservers []string
+	Search      []string
+}
+
+// NetworkRoute routes the CIDR To via a gateway.
+type NetworkRoute struct {
+	To  string
+	Via string
+}
+
+// static reports whether the NIC needs a network-config entry.
+func (n *NetworkInterface) static() bool {
+	return len(n.Addresses) > 0 || len(n.Routes) > 0 || n.MTU != 0 || len(n.Nameservers) > 0 || len(n.Search) > 0
+}
+
+// parseNetworkInterfaces reads NICs from annotations, defaulting to a single
+// vmnet-shared interface. MACs not given explicitly are derived from
+// namespace, container ID and index so they are stable across boots.
+func parseNetworkInterfaces(ns, id string, annotations map[string]string) ([]NetworkInterface, error) {
+	indexed, err := indexedAnnotations(annotations, AnnotationNetworkPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexed) == 0 {
+		indexed[0] = map[string]string{}
+	}
+	var nics []NetworkInterface
+	for i, n := range sortedIndexes(indexed) {
+		if i != n {
+			return nil, fmt.Errorf("network interface %v is not declared", i)
+		}
+		conf := indexed[n]
+		nic := NetworkInterface{
+			Mode:   conf["mode"],
+			Source: conf["source"],
+			Model:  conf["model"],
+			MAC:    conf["mac"],
+		}
+		if nic.Mode == "" {
+			nic.Mode = NetworkModeVmnetShared
+		}
+		if nic.Model == "" {
+			nic.Model = defaultNetworkModel
+		}
+		switch nic.Mode {
+		case NetworkModeVmnetShared, NetworkModeVmnetHost, NetworkModeUser:
+		case NetworkModeVmnetBridged, NetworkModeNetwork, NetworkModeBridge:
+			if nic.Source == "" {
+				return nil, fmt.Errorf("network interface %v: mode %v requires a source", n, nic.Mode)
+			}
+		default:
+			return nil, fmt.Errorf("network interface %v: unsupported mode %q", n, nic.Mode)
+		}
+		if nic.MAC == "" {
+			nic.MAC = deriveMAC(ns, id, n)
+		} else {
+			mac, err := net.ParseMAC(nic.MAC)
+			if err != nil {
+				return nil, errors.Wrapf(err, "network interface %v: invalid MAC %q", n, nic.MAC)
+			}
+			if len(mac) != 6 {
+				return nil, fmt.Errorf("network interface %v: %v is not a 48-bit MAC", n, nic.MAC)
+			}
+			if mac[0]&1 == 1 {
+				return nil, fmt.Errorf("network interface %v: %v is a multicast MAC", n, nic.MAC)
+			}
+			nic.MAC = mac.String()
+		}
+		if err := parseStaticNetwork(&nic, conf); err != nil {
+			return nil, errors.Wrapf(err, "network interface %v", n)
+		}
+		nics = append(nics, nic)
+	}
+	return nics, nil
+}
+
+// parseStaticNetwork reads the guest side settings of a NIC:
+// addresses and nameservers are comma separated, gateway takes an IPv4
+// and/or IPv6 address, routes are comma separated "<cidr>=<via>" pairs.
+func parseStaticNetwork(nic *NetworkInterface, conf map[string]string) error {
+	for _, addr := range splitList(conf["addresses"]) {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return errors.Wrapf(err, "invalid address %q", addr)
+		}
+		nic.Addresses = append(nic.Addresses, addr)
+	}
+	for _, gw := range splitList(conf["gateway"]) {
+		if net.ParseIP(gw) == nil {
+			return fmt.Errorf("invalid gateway %q", gw)
+		}
+		to := "0.0.0.0/0"
+		if strings.Contains(gw, ":") {
+			to = "::/0"
+		}
+		nic.Routes = append(nic.Routes, NetworkRoute{To: to, Via: gw})
+	}
+	for _, route := range splitList(conf["routes"]) {
+		to, via, ok := strings.Cut(route, "=")
+		if !ok {
+			return fmt.Errorf("invalid route %q, expect <cidr>=<via>", route)
+		}
+		if _, _, err := net.ParseCIDR(to); err != nil {
+			return errors.Wrapf(err, "invalid route destination %q", to)
+		}
+		if net.ParseIP(via) == nil {
+			return fmt.Errorf("invalid route gateway %q", via)
+		}
+		nic.Routes = append(nic.Routes, NetworkRoute{To: to, Via: via})
+	}
+	if mtu := conf["mtu"]; mtu != "" {
+		n, err := strconv.Atoi(mtu)
+		if err != nil || n < 68 || n > 65535 {
+			return fmt.Errorf("invalid MTU %q", mtu)
+		}
+		nic.MTU = n
+	}
+	for _, ns := range splitList(conf["nameservers"]) {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+		nic.Nameservers = append(nic.Nameservers, ns)
+	}
+	nic.Search = splitList(conf["search"])
+	return nil
+}
+
+// deriveMAC returns a locally administered MAC in the QEMU range 52:54:00.
+func deriveMAC(ns, id string, index int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v", ns, id, index)))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+func renderNetworkInterfaces(dom *libvirtxml.Domain, nics []NetworkInterface) {
+	for i, nic := range nics {
+		switch nic.Mode {
+		case NetworkModeVmnetShared, NetworkModeVmnetHost, NetworkModeVmnetBridged:
+			// Automatic tap interface setup is not supported on macOS,
+			// use vmNet API from HVF instead.
+			netdev := fmt.Sprintf("%v,id=net%v", nic.Mode, i)
+			if nic.Mode == NetworkModeVmnetBridged {
+				netdev += ",ifname=" + nic.Source
+			}
+			device := fmt.Sprintf("%v,netdev=net%v,mac=%v", qemuNetworkDevice(nic.Model), i, nic.MAC)
+			if dom.QEMUCommandline == nil {
+				dom.QEMUCommandline = &libvirtxml.DomainQEMUCommandline{}
+			}
+			dom.QEMUCommandline.Args = append(dom.QEMUCommandline.Args,
+				libvirtxml.DomainQEMUCommandlineArg{Value: "-netdev"},
+				libvirtxml.DomainQEMUCommandlineArg{Value: netdev},
+				libvirtxml.DomainQEMUCommandlineArg{Value: "-device"},
+				libvirtxml.DomainQEMUCommandlineArg{Value: device},
+			)
+		default:
+			iface := libvirtxml.DomainInterface{
+				MAC:    &libvirtxml.DomainInterfaceMAC{Address: nic.MAC},
+				Model:  &libvirtxml.DomainInterfaceModel{Type: nic.Model},
+				Source: &libvirtxml.DomainInterfaceSource{},
+			}
+			switch nic.Mode {
+			case NetworkModeUser:
+				iface.Source.User = &libvirtxml.DomainInterfaceSourceUser{}
+			case NetworkModeNetwork:
+				iface.Source.Network = &libvirtxml.DomainInterfaceSourceNetwork{Network: nic.Source}
+			case NetworkModeBridge:
+				iface.Source.Bridge = &libvirtxml.DomainInterfaceSourceBridge{Bridge: nic.Source}
+			}
+			dom.Devices.Interfaces = append(dom.Devices.Interfaces, iface)
+		}
+	}
+}
+
+// qemuNetworkDevice maps a libvirt model name to the QEMU device for vmnet NICs.
+func qemuNetworkDevice(model string) string {
+	if model == "virtio" {
+		return "virtio-net-device"
+	}
+	return model
+}
+
+// networkConfigV2 is a cloud-init network-config version 2 document, see
+// https://cloudinit.readthedocs.io/en/latest/reference/network-config-format-v2.html
+type networkConfigV2 struct {
+	Version   int                         `yaml:"version"`
+	Ethernets map[string]ethernetConfigV2 `yaml:"ethernets"`
+}
+
+type ethernetConfigV2 struct {
+	Match       map[string]string `yaml:"match"`
+	DHCP4       bool              `yaml:"dhcp4"`
+	DHCP6       bool              `yaml:"dhcp6"`
+	Addresses   []string          `yaml:"addresses,omitempty"`
+	Routes      []routeV2         `yaml:"routes,omitempty"`
+	MTU         int               `yaml:"mtu,omitempty"`
+	Nameservers *nameserversV2    `yaml:"nameservers,omitempty"`
+}
+
+type routeV2 struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+type nameserversV2 struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+// renderNetworkConfig returns the network-config for the guest, or nil when
+// cloud-init's default of DHCP on the first NIC is enough.
+func renderNetworkConfig(nics []NetworkInterface) ([]byte, error) {
+	needed := len(nics) > 1
+	for i := range nics {
+		needed = needed || nics[i].static()
+	}
+	if !needed {
+		return nil, nil
+	}
+	conf := networkConfigV2{
+		Version:   2,
+		Ethernets: make(map[string]ethernetConfigV2, len(nics)),
+	}
+	for i, nic := range nics {
+		eth := ethernetConfigV2{
+			Match:     map[string]string{"macaddress": nic.MAC},
+			DHCP4:     len(nic.Addresses) == 0,
+			Addresses: nic.Addresses,
+			MTU:       nic.MTU,
+		}
+		for _, route := range nic.Routes {
+			eth.Routes = append(eth.Routes, routeV2{To: route.To, Via: route.Via})
+		}
+		if len(nic.Nameservers) > 0 || len(nic.Search) > 0 {
+			eth.Nameservers = &nameserversV2{Addresses: nic.Nameservers, Search: nic.Search}
+		}
+		conf.Ethernets[fmt.Sprintf("net%v", i)] = eth
+	}
+	return marshalYAML(conf)
+}
@@ -0,0 +1,154 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"containerd-hvf/pkg/iso9660"
+	"containerd-hvf/pkg/oci"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Image formats written by Pack.
+const (
+	PackFormatOCI    = "oci"
+	PackFormatDocker = "docker"
+)
+
+// LabelImageArch is the label and manifest annotation recording the
+// architecture of packed images.
+const LabelImageArch = annotationPrefix + "image.arch"
+
+// PackOptions describes an image built from a boot disk and a cloud-init
+// directory.
+type PackOptions struct {
+	// Disk is the qcow2 boot disk, it must not have a backing file.
+	Disk string
+	// CloudInit is a directory with the seed files, e.g. meta-data and
+	// user-data.
+	CloudInit string
+	Ref       string
+	Output    string
+	// Format is PackFormatOCI or PackFormatDocker.
+	Format string
+	// Arch is the GOARCH of the guest, e.g. arm64.
+	Arch string
+	// Kernel, Initrd and Cmdline are shipped for direct kernel boot, when
+	// Kernel is set.
+	Kernel  string
+	Initrd  string
+	Cmdline string
+}
+
+// Pack writes an image laid out like the ones setupRootFS boots, without
+// any container runtime or image builder.
+func Pack(opts *PackOptions) (ocispec.Descriptor, error) {
+	named, err := docker.ParseDockerRef(opts.Ref)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid reference %q: %v", opts.Ref, err)
+	}
+	tag := "latest"
+	if tagged, ok := named.(docker.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	info, err := getImageInfo(opts.Disk)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if info.Format != "qcow2" {
+		return ocispec.Descriptor{}, errors.Wrapf(ErrInvalidImage, "%v is a %v image, expect qcow2", opts.Disk, info.Format)
+	}
+	if info.BackingFilename != "" {
+		return ocispec.Descriptor{}, errors.Wrapf(ErrInvalidImage, "%v is backed by %v, flatten it first", opts.Disk, info.BackingFilename)
+	}
+	if info.DirtyFlag || info.Corrupt() {
+		return ocispec.Descriptor{}, errors.Wrapf(ErrInvalidImage, "%v is dirty or corrupt", opts.Disk)
+	}
+	labels := map[string]string{LabelImageArch: opts.Arch}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(opts.Output), ".hvf-pack-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.RemoveAll(tmp)
+	seed := filepath.Join(tmp, defaultCloudInitImageFileName)
+	if err := writeSeed(opts.CloudInit, seed); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	files := []oci.File{
+		{Name: defaultRootImagePath + "/" + defaultRootImageFileName, Path: opts.Disk},
+		{Name: defaultRootImagePath + "/" + defaultCloudInitImageFileName, Path: seed},
+	}
+	if opts.Kernel != "" {
+		files = append(files, oci.File{Name: defaultRootImagePath + "/" + kernelFileName, Path: opts.Kernel})
+		if opts.Initrd != "" {
+			files = append(files, oci.File{Name: defaultRootImagePath + "/" + initrdFileName, Path: opts.Initrd})
+		}
+		if opts.Cmdline != "" {
+			cmdline := filepath.Join(tmp, cmdlineFileName)
+			if err := os.WriteFile(cmdline, []byte(opts.Cmdline+"\n"), 0644); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			files = append(files, oci.File{Name: defaultRootImagePath + "/" + cmdlineFileName, Path: cmdline})
+		}
+	} else if opts.Initrd != "" || opts.Cmdline != "" {
+		return ocispec.Descriptor{}, errors.Wrap(errdefs.ErrInvalidArgument, "initrd and cmdline need a kernel")
+	}
+	img := &oci.Image{
+		Name:         named.String(),
+		Tag:          tag,
+		Files:        files,
+		Labels:       labels,
+		Annotations:  labels,
+		Created:      time.Now(),
+		CreatedBy:    fmt.Sprintf("pack of %v", filepath.Base(opts.Disk)),
+		OS:           "linux",
+		Architecture: opts.Arch,
+	}
+	switch opts.Format {
+	case PackFormatOCI, "":
+		return oci.WriteLayout(opts.Output, img)
+	case PackFormatDocker:
+		return oci.WriteDockerArchive(opts.Output, docker.FamiliarString(named), img)
+	default:
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrInvalidArgument, "unsupported format %q", opts.Format)
+	}
+}
+
+// writeSeed writes the regular files of dir as a cloud-init NoCloud seed.
+func writeSeed(dir, path string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			return fmt.Errorf("%v: only regular files are supported in seeds", filepath.Join(dir, entry.Name()))
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		files[entry.Name()] = data
+	}
+	if _, ok := files["meta-data"]; !ok {
+		// NoCloud requires it, even if empty.
+		files["meta-data"] = []byte{}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := iso9660.Write(f, cloudInitLabel, files); err != nil {
+		return errors.Wrapf(err, "failed to write cloud-init seed %v", path)
+	}
+	return f.Close()
+}
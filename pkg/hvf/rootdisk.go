@@ -0,0 +1,63 @@
+package hvf
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// rootOverlayFileName is the per-container root disk created in the bundle
+// on top of the image, which is never written to directly then.
+const rootOverlayFileName = "root.qcow2"
+
+// setupRootDisk grows the root disk to the size requested by annotation.
+// The image is shared by every container created from it, so a qcow2
+// overlay backed by it is created in the bundle with the requested virtual
+// size, and cloud-init grows the partition and filesystem on first boot.
+// Images in other formats may be converted to qcow2 first for the overlay
+// to perform better.
+func (v *VM) setupRootDisk(image string, info *QemuImageInfo) error {
+	sizeValue, ok := v.spec.Annotations[AnnotationRootSize]
+	if !ok {
+		return nil
+	}
+	size, err := parseSize(sizeValue)
+	if err != nil {
+		return errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+	}
+	if size < info.VirtualSize {
+		return errors.Wrapf(errdefs.ErrInvalidArgument,
+			"root disk size %v is smaller than the %v bytes of the image, shrinking is not supported", sizeValue, info.VirtualSize)
+	}
+	format := info.Format
+	if format != "qcow2" && v.config.RootConvert {
+		image, err = convertImage(image, format)
+		if err != nil {
+			return err
+		}
+		format = "qcow2"
+	}
+	overlay := filepath.Join(v.bundle, rootOverlayFileName)
+	if err := createOverlay(image, format, overlay, size); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"image": image, "overlay": overlay, "size": size}).Info("grew root disk")
+	v.config.RootImage = overlay
+	v.config.RootFormat = "qcow2"
+	v.config.GrowRoot = true
+	return nil
+}
+
+// createOverlay creates a qcow2 image at path backed by image.
+func createOverlay(image, format, path string, size uint64) error {
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", format, "-b", image, path, strconv.FormatUint(size, 10))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to create overlay of %v: %s", image, out))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package hvf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// shimLogDir holds a directory of logs per container.
+const shimLogDir = "/var/log/containerd-shim-hvf-v1"
+
+// Screenshot writes the screen of the running or paused VM as a PNG at the
+// absolute path output.
+func (v *VM) Screenshot(ctx context.Context, output string) error {
+	if !filepath.IsAbs(output) {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "output %q must be absolute", output)
+	}
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkState("take a screenshot of", StateRunning, StatePaused)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	mime, err := v.client.DomainScreenshot(v.domainMeta, buf, 0, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to take a screenshot of VM '%v'", v.domain.Name)
+	}
+	data := buf.Bytes()
+	// QEMU dumps PPM, or PNG when asked to by recent libvirt versions.
+	if len(mime) == 0 || mime[0] != "image/png" {
+		img, err := decodePPM(bufio.NewReader(buf))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read screenshot of type %v", mime)
+		}
+		out := &bytes.Buffer{}
+		if err := png.Encode(out, img); err != nil {
+			return err
+		}
+		data = out.Bytes()
+	}
+	f, err := os.CreateTemp(filepath.Dir(output), ".screenshot-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), output)
+}
+
+// screenshotOnTimeout saves the screen next to the shim log when the VM
+// didn't get ready in time, if asked to.
+func (v *VM) screenshotOnTimeout() {
+	if !v.config.ScreenshotOnTimeout {
+		return
+	}
+	output := filepath.Join(shimLogDir, v.id, fmt.Sprintf("timeout-%v.png", time.Now().Format("20060102-150405")))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := v.Screenshot(ctx, output); err != nil {
+		logrus.WithError(err).Error("failed to take a screenshot on timeout")
+		return
+	}
+	logrus.WithField("path", output).Info("saved a screenshot of the VM not ready in time")
+}
+
+// decodePPM decodes a binary (P6) PPM image.
+func decodePPM(r *bufio.Reader) (image.Image, error) {
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != "P6" {
+		return nil, errors.Errorf("unsupported image format %q", magic)
+	}
+	// Width, height and maximum value, separated by whitespace and comments.
+	var header [3]int
+	for i := range header {
+		n, err := ppmInt(r)
+		if err != nil {
+			return nil, err
+		}
+		header[i] = n
+	}
+	width, height, maxValue := header[0], header[1], header[2]
+	if width <= 0 || height <= 0 || maxValue <= 0 || maxValue > 65535 {
+		return nil, errors.Errorf("invalid PPM header %vx%v %v", width, height, maxValue)
+	}
+	bytesPerSample := 1
+	if maxValue > 255 {
+		bytesPerSample = 2
+	}
+	row := make([]byte, width*3*bytesPerSample)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			var rgb [3]uint8
+			for c := range rgb {
+				offset := (x*3 + c) * bytesPerSample
+				sample := int(row[offset])
+				if bytesPerSample == 2 {
+					sample = sample<<8 | int(row[offset+1])
+				}
+				rgb[c] = uint8(sample * 255 / maxValue)
+			}
+			img.SetRGBA(x, y, color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255})
+		}
+	}
+	return img, nil
+}
+
+// ppmInt reads a decimal of a PPM header and the single whitespace after
+// it.
+func ppmInt(r *bufio.Reader) (int, error) {
+	n, digits := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case b == '#' && digits == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return 0, err
+			}
+		case b >= '0' && b <= '9':
+			if n > 1<<24 {
+				return 0, errors.New("PPM header value out of range")
+			}
+			n = n*10 + int(b-'0')
+			digits++
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if digits > 0 {
+				return n, nil
+			}
+		default:
+			return 0, errors.Errorf("invalid PPM header byte %q", b)
+		}
+	}
+}
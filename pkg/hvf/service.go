@@ -0,0 +1,160 @@
+package hvf
+
+import (
+	"context"
+	"os"
+
+	"containerd-hvf/pkg/api"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/ttrpc"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// vmService implements api.VMService for the VMs of a TaskService.
+type vmService struct {
+	s *TaskService
+}
+
+func (c *vmService) RegisterTTRPC(server *ttrpc.Server) error {
+	api.RegisterVMService(server, c)
+	return nil
+}
+
+func (c *vmService) getVM(id string) (*VM, error) {
+	return c.s.getVM(id)
+}
+
+func (c *vmService) CreateSnapshot(ctx context.Context, r *api.CreateSnapshotRequest) (resp *api.Snapshot, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("VM CreateSnapshot")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := vm.CreateSnapshot(ctx, r.Name, r.Description, r.Memory)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return toSnapshot(info), nil
+}
+
+func (c *vmService) ListSnapshots(ctx context.Context, r *api.ListSnapshotsRequest) (*api.ListSnapshotsResponse, error) {
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := vm.ListSnapshots(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	resp := &api.ListSnapshotsResponse{}
+	for i := range infos {
+		resp.Snapshots = append(resp.Snapshots, toSnapshot(&infos[i]))
+	}
+	return resp, nil
+}
+
+func (c *vmService) RevertSnapshot(ctx context.Context, r *api.RevertSnapshotRequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("VM RevertSnapshot")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.RevertSnapshot(ctx, r.Name); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *vmService) DeleteSnapshot(ctx context.Context, r *api.DeleteSnapshotRequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("VM DeleteSnapshot")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.DeleteSnapshot(ctx, r.Name); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *vmService) Commit(ctx context.Context, r *api.CommitRequest) (resp *api.CommitResponse, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("VM Commit")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := vm.Commit(ctx, r.Ref, r.Output, r.Labels)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	stat, err := os.Stat(r.Output)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &api.CommitResponse{Digest: desc.Digest.String(), Size: stat.Size()}, nil
+}
+
+func (c *vmService) CopyFile(ctx context.Context, r *api.CopyFileToGuestRequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("VM CopyFile")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.CopyFile(ctx, r.Source, r.Destination, os.FileMode(r.Mode)); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *vmService) Screenshot(ctx context.Context, r *api.ScreenshotRequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("VM Screenshot")
+	}()
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.Screenshot(ctx, r.Output); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *vmService) Lifecycle(ctx context.Context, r *api.LifecycleRequest) (*api.LifecycleResponse, error) {
+	vm, err := c.getVM(r.Id)
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.LifecycleResponse{State: string(vm.State())}
+	for _, t := range vm.Transitions() {
+		resp.Transitions = append(resp.Transitions, &api.LifecycleTransition{
+			From:   string(t.From),
+			To:     string(t.To),
+			Reason: t.Reason,
+			At:     timestamppb.New(t.At),
+		})
+	}
+	return resp, nil
+}
+
+func toSnapshot(info *SnapshotInfo) *api.Snapshot {
+	return &api.Snapshot{
+		Name:        info.Name,
+		Description: info.Description,
+		Memory:      info.Memory,
+		CreatedAt:   timestamppb.New(info.CreatedAt),
+		Parent:      info.Parent,
+	}
+}
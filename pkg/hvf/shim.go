@@ -16,16 +16,22 @@ import (
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/pkg/process"
 	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/containerd/plugin"
 	"github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/containerd/typeurl/v2"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func Init(ctx context.Context, s string, publisher shim.Publisher, f func()) (shim.Shim, error) {
 
+	ns, _ := namespaces.Namespace(ctx)
 	svc := &TaskService{
+		namespace: ns,
 		id:        s,
 		context:   ctx,
 		events:    make(chan interface{}, 128),
@@ -37,6 +43,15 @@ func Init(ctx context.Context, s string, publisher shim.Publisher, f func()) (sh
 
 	go svc.forward(ctx, publisher)
 
+	// Serve the VM specific API next to the task one.
+	plugin.Register(&plugin.Registration{
+		Type: plugin.TTRPCPlugin,
+		ID:   "hvf",
+		InitFn: func(ic *plugin.InitContext) (interface{}, error) {
+			return &vmService{s: svc}, nil
+		},
+	})
+
 	if address, err := shim.ReadAddress("address"); err == nil {
 		svc.shimAddress = address
 	}
@@ -47,6 +62,7 @@ func Init(ctx context.Context, s string, publisher shim.Publisher, f func()) (sh
 type TaskService struct {
 	mu sync.Mutex
 
+	namespace string
 	id        string
 	events    chan interface{}
 	context   context.Context
@@ -54,34 +70,84 @@ type TaskService struct {
 	cancel    func()
 	processes map[string]process.Process
 
+	// vm is nil for the VMs being initialized.
 	vm map[string]*VM
 
+	// eventsMu guards closing events, which VM goroutines may still send
+	// to on Shutdown.
+	eventsMu sync.Mutex
+	closed   bool
+
 	shimAddress string
 	f           *os.File
 }
 
+// getVM returns the VM of a task.
+func (s *TaskService) getVM(id string) (*VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vm[id]
+	if !ok {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrNotFound, "VM %v", id))
+	}
+	if vm == nil {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrUnavailable, "VM %v is being created", id))
+	}
+	return vm, nil
+}
+
 func (s *TaskService) State(ctx context.Context, r *task.StateRequest) (resp *task.StateResponse, err error) {
 	defer logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task State")
-	vm, ok := s.vm[r.ID]
-	if !ok {
-		return &task.StateResponse{}, errdefs.ToGRPC(errors.New("process not found"))
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return &task.StateResponse{}, err
+	}
+	if r.ExecID != "" {
+		p, err := vm.GetExec(r.ExecID)
+		if err != nil {
+			return &task.StateResponse{}, errdefs.ToGRPC(err)
+		}
+		pid, started := p.state()
+		status := task2.Status_CREATED
+		if p.Exited() {
+			status = task2.Status_STOPPED
+		} else if started {
+			status = task2.Status_RUNNING
+		}
+		resp := &task.StateResponse{
+			ID:       r.ExecID,
+			Bundle:   vm.bundle,
+			Pid:      pid,
+			Status:   status,
+			Stdin:    p.stdio.Stdin,
+			Stdout:   p.stdio.Stdout,
+			Stderr:   p.stdio.Stderr,
+			Terminal: p.stdio.Terminal,
+		}
+		if p.Exited() {
+			resp.ExitStatus = p.exitStatus
+			resp.ExitedAt = timestamppb.New(p.exitedAt)
+		}
+		return resp, nil
 	}
 	status, err := vm.Status(ctx)
 	if err != nil {
 		return &task.StateResponse{}, errdefs.ToGRPC(err)
 	}
+	stdio := vm.Stdio()
+	exitedAt := vm.ExitedAt()
 
 	return &task.StateResponse{
 		ID:         vm.ID(),
 		Bundle:     vm.bundle,
 		Pid:        vm.Pid(),
 		Status:     fromStatus(status),
-		Stdin:      vm.stdio.Stdin,
-		Stdout:     vm.stdio.Stdout,
-		Stderr:     vm.stdio.Stderr,
-		Terminal:   vm.stdio.Terminal,
-		ExitStatus: uint32(vm.status),
-		ExitedAt:   timestamppb.New(vm.exitedAt),
+		Stdin:      stdio.Stdin,
+		Stdout:     stdio.Stdout,
+		Stderr:     stdio.Stderr,
+		Terminal:   stdio.Terminal,
+		ExitStatus: vm.exitCode.Load(),
+		ExitedAt:   timestamppb.New(exitedAt),
 	}, nil
 }
 
@@ -105,14 +171,31 @@ func (s *TaskService) Create(ctx context.Context, r *task.CreateTaskRequest) (re
 	defer func() {
 		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task Create")
 	}()
-	logDir := filepath.Join("/var/log/containerd-shim-hvf-v1", r.ID)
+	s.mu.Lock()
+	if _, ok := s.vm[r.ID]; ok {
+		s.mu.Unlock()
+		return &task.CreateTaskResponse{}, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrAlreadyExists, "VM %v", r.ID))
+	}
+	// Reserve the ID, Init takes too long to hold the lock.
+	s.vm[r.ID] = nil
+	s.mu.Unlock()
+	defer func() {
+		if err != nil {
+			s.mu.Lock()
+			delete(s.vm, r.ID)
+			s.mu.Unlock()
+		}
+	}()
+	logDir := filepath.Join(shimLogDir, r.ID)
 	_ = os.MkdirAll(logDir, os.ModePerm)
 	f, err := os.OpenFile(filepath.Join(logDir, "shim.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return &task.CreateTaskResponse{}, err
 	}
 	// Persist shim logs as rootfs must be empty when shim exits.
+	s.mu.Lock()
 	s.f = f
+	s.mu.Unlock()
 	logrus.SetOutput(f)
 	spec, err := readSpec()
 	if err != nil {
@@ -126,18 +209,23 @@ func (s *TaskService) Create(ctx context.Context, r *task.CreateTaskRequest) (re
 		Terminal: r.Terminal,
 	}
 
-	vm, err := NewVM(r.ID, stdioObj, spec, r.Bundle, r.Rootfs)
+	vm, err := NewVM(s.namespace, r.ID, stdioObj, spec, r.Bundle, r.Rootfs)
 	if err != nil {
 		return &task.CreateTaskResponse{}, errdefs.ToGRPC(errors.Wrap(err, "failed to create VM"))
 	}
-	s.mu.Lock()
-	s.vm[vm.ID()] = vm
-	s.mu.Unlock()
-
+	vm.events = s.send
 	err = vm.Init()
 	if err != nil {
+		// Release what Init set up, and the libvirt connection.
+		if _, deleteErr := vm.Delete(ctx); deleteErr != nil {
+			logrus.WithError(deleteErr).Error("failed to clean up VM")
+		}
 		return &task.CreateTaskResponse{}, errdefs.ToGRPC(errors.Wrap(err, "failed to initialize VM"))
 	}
+	// Other requests only see the VM once it is initialized.
+	s.mu.Lock()
+	s.vm[vm.ID()] = vm
+	s.mu.Unlock()
 
 	s.send(&events.TaskCreate{
 		ContainerID: r.ID,
@@ -162,9 +250,21 @@ func (s *TaskService) Start(ctx context.Context, r *task.StartRequest) (resp *ta
 	defer func() {
 		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task Start")
 	}()
-	vm, ok := s.vm[r.ID]
-	if !ok {
-		return nil, errdefs.ToGRPC(errors.New("process not found"))
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" {
+		pid, err := vm.StartExec(ctx, r.ExecID)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		s.send(&events.TaskExecStarted{
+			ContainerID: r.ID,
+			ExecID:      r.ExecID,
+			Pid:         pid,
+		})
+		return &task.StartResponse{Pid: pid}, nil
 	}
 
 	err = vm.Start(ctx)
@@ -191,9 +291,21 @@ func (s *TaskService) Delete(ctx context.Context, r *task.DeleteRequest) (resp *
 	defer func() {
 		logrus.WithError(err).WithField("req", r).WithField("resp", resp).Info("Task Delete")
 	}()
-	vm, ok := s.vm[r.ID]
-	if !ok {
-		return nil, errdefs.ToGRPC(errors.New("process not found"))
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" {
+		p, err := vm.DeleteExec(ctx, r.ExecID)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		pid, _ := p.state()
+		return &task.DeleteResponse{
+			ExitStatus: p.exitStatus,
+			ExitedAt:   timestamppb.New(p.exitedAt),
+			Pid:        pid,
+		}, nil
 	}
 	exitStatus, err := vm.Delete(ctx)
 	if err != nil {
@@ -225,25 +337,64 @@ func (s *TaskService) Pids(ctx context.Context, r *task.PidsRequest) (resp *task
 	defer func() {
 		logrus.WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task Pids")
 	}()
+	if vm, err := s.getVM(r.ID); err == nil && vm.config.Agent.Enabled {
+		guest, err := vm.Processes(ctx)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		processes := make([]*task2.ProcessInfo, 0, len(guest))
+		for _, p := range guest {
+			processes = append(processes, &task2.ProcessInfo{Pid: p.Pid})
+		}
+		return &task.PidsResponse{Processes: processes}, nil
+	}
+	s.mu.Lock()
 	processes := make([]*task2.ProcessInfo, 0, len(s.processes))
 	for _, p := range s.processes {
 		processes = append(processes, &task2.ProcessInfo{
 			Pid: uint32(p.Pid()),
 		})
 	}
+	s.mu.Unlock()
 	return &task.PidsResponse{
 		Processes: processes,
 	}, nil
 }
 
-func (s *TaskService) Pause(ctx context.Context, r *task.PauseRequest) (*emptypb.Empty, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task Pause")
-	return nil, nil
+func (s *TaskService) Pause(ctx context.Context, r *task.PauseRequest) (resp *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Pause")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = vm.Pause(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	s.send(&events.TaskPaused{
+		ContainerID: r.ID,
+	})
+	return &emptypb.Empty{}, nil
 }
 
-func (s *TaskService) Resume(ctx context.Context, r *task.ResumeRequest) (*emptypb.Empty, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task Resume")
-	return nil, nil
+func (s *TaskService) Resume(ctx context.Context, r *task.ResumeRequest) (resp *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Resume")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = vm.Resume(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	s.send(&events.TaskResumed{
+		ContainerID: r.ID,
+	})
+	return &emptypb.Empty{}, nil
 }
 
 func (s *TaskService) Checkpoint(ctx context.Context, r *task.CheckpointTaskRequest) (*emptypb.Empty, error) {
@@ -255,17 +406,54 @@ func (s *TaskService) Kill(ctx context.Context, r *task.KillRequest) (resp *empt
 	defer func() {
 		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Kill")
 	}()
-	vm, ok := s.vm[r.ID]
-	if !ok {
-		return nil, errdefs.ToGRPC(errors.New("process not found"))
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" {
+		err = vm.KillExec(ctx, r.ExecID, syscall.Signal(r.Signal))
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		return &emptypb.Empty{}, nil
 	}
 	err = vm.Kill(ctx, syscall.Signal(r.Signal))
-	return &emptypb.Empty{}, err
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
 }
 
-func (s *TaskService) Exec(ctx context.Context, r *task.ExecProcessRequest) (*emptypb.Empty, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task Exec")
-	return nil, nil
+func (s *TaskService) Exec(ctx context.Context, r *task.ExecProcessRequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Exec")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := typeurl.UnmarshalAny(r.Spec)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	spec, ok := v.(*specs.Process)
+	if !ok {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrInvalidArgument, "unsupported process spec %T", v))
+	}
+	err = vm.AddExec(r.ExecID, spec, stdio.Stdio{
+		Stdin:    r.Stdin,
+		Stdout:   r.Stdout,
+		Stderr:   r.Stderr,
+		Terminal: r.Terminal,
+	})
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	s.send(&events.TaskExecAdded{
+		ContainerID: r.ID,
+		ExecID:      r.ExecID,
+	})
+	return &emptypb.Empty{}, nil
 }
 
 func (s *TaskService) ResizePty(ctx context.Context, r *task.ResizePtyRequest) (*emptypb.Empty, error) {
@@ -273,23 +461,67 @@ func (s *TaskService) ResizePty(ctx context.Context, r *task.ResizePtyRequest) (
 	return nil, nil
 }
 
-func (s *TaskService) CloseIO(ctx context.Context, r *task.CloseIORequest) (*emptypb.Empty, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task CloseIO")
-	return nil, nil
+func (s *TaskService) CloseIO(ctx context.Context, r *task.CloseIORequest) (_ *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task CloseIO")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" && r.Stdin {
+		if err := vm.CloseExecStdin(r.ExecID); err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+	}
+	return &emptypb.Empty{}, nil
 }
 
-func (s *TaskService) Update(ctx context.Context, r *task.UpdateTaskRequest) (*emptypb.Empty, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task Update")
-	return nil, nil
+func (s *TaskService) Update(ctx context.Context, r *task.UpdateTaskRequest) (resp *emptypb.Empty, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Update")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	var resources *specs.LinuxResources
+	if r.Resources != nil {
+		v, err := typeurl.UnmarshalAny(r.Resources)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		var ok bool
+		resources, ok = v.(*specs.LinuxResources)
+		if !ok {
+			return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrInvalidArgument, "unsupported resources %T", v))
+		}
+	}
+	// Empty updates are still refused once the VM is deleted.
+	err = vm.UpdateIOTune(resources)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
 }
 
 func (s *TaskService) Wait(ctx context.Context, r *task.WaitRequest) (resp *task.WaitResponse, err error) {
 	defer func() {
 		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task Wait")
 	}()
-	vm, ok := s.vm[r.ID]
-	if !ok {
-		return nil, errdefs.ToGRPC(errors.New("process not found"))
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" {
+		exitStatus, exitedAt, err := vm.WaitExec(ctx, r.ExecID)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+		return &task.WaitResponse{
+			ExitStatus: exitStatus,
+			ExitedAt:   timestamppb.New(exitedAt),
+		}, nil
 	}
 	waitChan, err := vm.Wait(ctx)
 	if err != nil {
@@ -301,13 +533,28 @@ func (s *TaskService) Wait(ctx context.Context, r *task.WaitRequest) (resp *task
 	exitStatus := <-waitChan
 	return &task.WaitResponse{
 		ExitStatus: exitStatus.ExitCode(),
-		ExitedAt:   timestamppb.Now(),
+		ExitedAt:   timestamppb.New(exitStatus.ExitTime()),
 	}, nil
 }
 
-func (s *TaskService) Stats(ctx context.Context, r *task.StatsRequest) (*task.StatsResponse, error) {
-	defer logrus.WithFields(logrus.Fields{"req": r}).Info("Task Stats")
-	return nil, nil
+func (s *TaskService) Stats(ctx context.Context, r *task.StatsRequest) (_ *task.StatsResponse, err error) {
+	defer func() {
+		logrus.WithError(err).WithFields(logrus.Fields{"req": r}).Info("Task Stats")
+	}()
+	vm, err := s.getVM(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := vm.Stats(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	// Guests have no cgroup of the host, their stats are reported as is.
+	data, err := anypb.New(stats)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &task.StatsResponse{Stats: data}, nil
 }
 
 // Connect returns shim information such as the shim's pid
@@ -316,7 +563,7 @@ func (s *TaskService) Connect(ctx context.Context, r *task.ConnectRequest) (resp
 		logrus.WithError(err).WithFields(logrus.Fields{"req": r, "resp": resp}).Info("Task Connect")
 	}()
 	var pid int
-	if vm, ok := s.vm[r.ID]; ok {
+	if vm, err := s.getVM(r.ID); err == nil {
 		pid = int(vm.Pid())
 	}
 
@@ -333,14 +580,28 @@ func (s *TaskService) Shutdown(ctx context.Context, r *task.ShutdownRequest) (*e
 	}
 
 	s.cancel()
-	close(s.events)
+	s.eventsMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.eventsMu.Unlock()
+	s.mu.Lock()
 	if s.f != nil {
 		_ = s.f.Close()
 	}
+	s.mu.Unlock()
 	return &emptypb.Empty{}, nil
 }
 
+// send queues an event, dropping the ones sent after Shutdown.
 func (s *TaskService) send(evt interface{}) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if s.closed {
+		logrus.WithField("e", evt).Debug("dropping event sent after shutdown")
+		return
+	}
 	s.events <- evt
 }
 
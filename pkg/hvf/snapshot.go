@@ -0,0 +1,238 @@
+package hvf
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// snapshotsFileName keeps the snapshots of the VM in the bundle.
+const snapshotsFileName = "snapshots.json"
+
+var validSnapshotName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// SnapshotInfo describes a libvirt snapshot of the VM.
+type SnapshotInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Memory      bool      `json:"memory"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Parent      string    `json:"parent,omitempty"`
+}
+
+// CreateSnapshot takes an internal snapshot of the qcow2 disks of the VM,
+// while it is stopped as QEMU can't take internal disk-only snapshots of a
+// running VM. Memory snapshots are refused: libvirt can't save the memory
+// internally along with the writable pflash NVRAM every VM boots with.
+func (v *VM) CreateSnapshot(ctx context.Context, name, description string, memory bool) (*SnapshotInfo, error) {
+	if !validSnapshotName.MatchString(name) {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid snapshot name %q", name)
+	}
+	if memory {
+		return nil, errors.Wrap(errdefs.ErrNotImplemented, "memory snapshots of VMs with a UEFI NVRAM")
+	}
+	// Keep the VM in its state, and snapshots.json consistent.
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkState("take a snapshot of", StateCreated, StateStopped)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := v.loadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Name == name {
+			return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "snapshot %v", name)
+		}
+	}
+
+	snapshot := libvirtxml.DomainSnapshot{
+		Name:        name,
+		Description: description,
+		Memory:      &libvirtxml.DomainSnapshotMemory{Snapshot: "no"},
+		Disks:       &libvirtxml.DomainSnapshotDisks{},
+	}
+	for _, disk := range v.domain.Devices.Disks {
+		mode := "no"
+		if disk.Device == "disk" && disk.ReadOnly == nil && disk.Driver != nil && disk.Driver.Type == "qcow2" {
+			mode = "internal"
+		}
+		snapshot.Disks.Disks = append(snapshot.Disks.Disks, libvirtxml.DomainSnapshotDisk{Name: disk.Target.Dev, Snapshot: mode})
+	}
+	xmlString, err := snapshot.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SnapshotInfo{
+		Name:        name,
+		Description: description,
+		CreatedAt:   time.Now(),
+	}
+	if current, err := v.client.DomainSnapshotCurrent(v.domainMeta, 0); err == nil {
+		info.Parent = current.Name
+	}
+	_, err = v.client.DomainSnapshotCreateXML(v.domainMeta, xmlString, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create snapshot %v", name)
+	}
+	return info, v.saveSnapshots(append(snapshots, *info))
+}
+
+// ListSnapshots returns the snapshots of the VM, oldest first.
+func (v *VM) ListSnapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	return v.loadSnapshots()
+}
+
+// RevertSnapshot restores the VM to a snapshot while it is stopped or
+// paused, and leaves it in that state.
+func (v *VM) RevertSnapshot(ctx context.Context, name string) error {
+	// The VM is left in its lifecycle state, keep it there meanwhile.
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkState("revert", StatePaused, StateCreated, StateStopped)
+	if err != nil {
+		return err
+	}
+	info, err := v.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	state := v.State()
+	var flags libvirt.DomainSnapshotRevertFlags
+	if state == StatePaused {
+		flags = libvirt.DomainSnapshotRevertPaused
+	} else if info.Memory {
+		// Reverting to a memory state always starts QEMU, keep it paused
+		// and stop it right away so that only the disks are restored.
+		// Only snapshots taken by earlier versions hold memory.
+		flags = libvirt.DomainSnapshotRevertPaused
+	}
+	snapshot, err := v.client.DomainSnapshotLookupByName(v.domainMeta, name, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up snapshot %v", name)
+	}
+	err = v.client.DomainRevertToSnapshot(snapshot, uint32(flags))
+	if err != nil {
+		return errors.Wrapf(err, "failed to revert to snapshot %v", name)
+	}
+	if state == StatePaused {
+		// Reverting a running domain restarts QEMU, under another pid.
+		v.mu.Lock()
+		v.pid = 0
+		v.mu.Unlock()
+	}
+	if state != StatePaused && info.Memory {
+		err = v.client.DomainDestroy(v.domainMeta)
+		if err != nil && !isNotRunning(err) {
+			return errors.Wrapf(err, "failed to stop VM '%v' after revert", v.domain.Name)
+		}
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot, its children are kept.
+func (v *VM) DeleteSnapshot(ctx context.Context, name string) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkState("delete a snapshot of", StateCreated, StateRunning, StatePaused, StateStopping, StateStopped)
+	if err != nil {
+		return err
+	}
+	info, err := v.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	snapshot, err := v.client.DomainSnapshotLookupByName(v.domainMeta, name, 0)
+	if err != nil && !libvirt.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to look up snapshot %v", name)
+	}
+	if err == nil {
+		if err := v.client.DomainSnapshotDelete(snapshot, 0); err != nil {
+			return errors.Wrapf(err, "failed to delete snapshot %v", name)
+		}
+	}
+	snapshots, err := v.loadSnapshots()
+	if err != nil {
+		return err
+	}
+	kept := snapshots[:0]
+	for _, s := range snapshots {
+		if s.Name == name {
+			continue
+		}
+		if s.Parent == name {
+			s.Parent = info.Parent
+		}
+		kept = append(kept, s)
+	}
+	return v.saveSnapshots(kept)
+}
+
+// removeSnapshots deletes every snapshot of the VM, on container delete.
+func (v *VM) removeSnapshots() error {
+	roots, _, err := v.client.DomainListAllSnapshots(v.domainMeta, 1, uint32(libvirt.DomainSnapshotListRoots))
+	if err != nil && !libvirt.IsNotFound(err) {
+		return errors.Wrap(err, "failed to list snapshots")
+	}
+	for _, root := range roots {
+		if err := v.client.DomainSnapshotDelete(root, libvirt.DomainSnapshotDeleteChildren); err != nil {
+			return errors.Wrapf(err, "failed to delete snapshot %v", root.Name)
+		}
+	}
+	err = os.Remove(filepath.Join(v.bundle, snapshotsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (v *VM) findSnapshot(name string) (*SnapshotInfo, error) {
+	snapshots, err := v.loadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, errors.Wrapf(errdefs.ErrNotFound, "snapshot %v", name)
+}
+
+func (v *VM) loadSnapshots() ([]SnapshotInfo, error) {
+	data, err := os.ReadFile(filepath.Join(v.bundle, snapshotsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []SnapshotInfo
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshots")
+	}
+	return snapshots, nil
+}
+
+func (v *VM) saveSnapshots(snapshots []SnapshotInfo) error {
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(v.bundle, snapshotsFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,33 @@
+package hvf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestMemorySnapshotRefused(t *testing.T) {
+	v := newTestVM(t, newFakeLibvirt(libvirt.DomainRunning))
+	_, err := v.CreateSnapshot(context.Background(), "full", "", true)
+	if !errdefs.IsNotImplemented(err) {
+		t.Errorf("got %v, expected not implemented", err)
+	}
+}
+
+func TestRevertPausedResetsPid(t *testing.T) {
+	v := newTestVM(t, newFakeLibvirt(libvirt.DomainPaused))
+	v.state = StatePaused
+	if err := v.saveSnapshots([]SnapshotInfo{{Name: "clean"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.RevertSnapshot(context.Background(), "clean"); err != nil {
+		t.Fatal(err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pid != 0 {
+		t.Errorf("pid %v kept after revert, expected it to be looked up again", v.pid)
+	}
+}
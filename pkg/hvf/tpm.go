@@ -0,0 +1,55 @@
+package hvf
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// swtpmStateDir is where libvirt keeps the state of emulated TPMs, by
+// domain UUID.
+const swtpmStateDir = "/opt/homebrew/var/lib/libvirt/swtpm"
+
+// setupTPM checks swtpm is installed when the VM has a TPM.
+func (v *VM) setupTPM() error {
+	if !v.config.TPM {
+		return nil
+	}
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		return errors.Wrap(errdefs.ErrFailedPrecondition, "a TPM requires swtpm, install it with `brew install swtpm`")
+	}
+	return nil
+}
+
+// renderTPM adds a TPM 2.0 emulated by swtpm. Its state is kept by libvirt
+// as long as the domain is defined, that is for the life of the container.
+func renderTPM(dom *libvirtxml.Domain, enabled bool) {
+	if !enabled {
+		return
+	}
+	// QEMU's CRB TPM is x86 only, libvirt maps tpm-tis to tpm-tis-device on
+	// aarch64.
+	model := "tpm-tis"
+	if dom.OS.Type.Arch == "x86_64" {
+		model = "tpm-crb"
+	}
+	dom.Devices.TPMs = append(dom.Devices.TPMs, libvirtxml.DomainTPM{
+		Model: model,
+		Backend: &libvirtxml.DomainTPMBackend{
+			Emulator: &libvirtxml.DomainTPMBackendEmulator{Version: "2.0"},
+		},
+	})
+}
+
+// removeTPMState removes the TPM state libvirt may have left behind once
+// the domain is undefined.
+func (v *VM) removeTPMState() error {
+	if !v.config.TPM || v.domain == nil {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(swtpmStateDir, v.domain.UUID))
+}
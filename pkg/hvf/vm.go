@@ -2,20 +2,22 @@ package hvf
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/api/types"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/ttrpc"
 	"github.com/digitalocean/go-libvirt"
 	"github.com/digitalocean/go-libvirt/socket/dialers"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -31,21 +33,47 @@ const defaultRootImageFileName = "boot.qcow2"
 const defaultCloudInitImageFileName = "cloudinit.iso"
 
 type VM struct {
-	id       string
-	stdio    stdio.Stdio
-	bundle   string
-	pid      int
-	status   int
-	started  bool
-	exited   bool
-	exitedAt time.Time
+	namespace string
+	id        string
+	bundle    string
+
+	// opMu serializes the lifecycle operations, from checking the state to
+	// the transition.
+	opMu sync.Mutex
+	// mu guards the fields below, as ttrpc serves requests concurrently.
+	// Changes made to domain and config after Init hold both opMu and mu,
+	// reading them takes either.
+	mu          sync.Mutex
+	stdio       stdio.Stdio
+	pid         int
+	state       State
+	transitions []Transition
+	exitedAt    time.Time
+
+	// exitCode is set when the VM is stopped by its watchdog or a panic.
+	exitCode atomic.Uint32
+	// killed is set once Kill was asked to stop the VM.
+	killed atomic.Bool
+	// diskLock locks the persistent root disk, guarded by mu.
+	diskLock *os.File
+	// guardStopped is closed once watchGuard handled the stop of the
+	// domain, guarded by mu.
+	guardStopped chan struct{}
+	// events publishes task events.
+	events func(interface{})
+
+	agentMu sync.Mutex
+	agent   *ttrpc.Client
+	execMu  sync.Mutex
+	execs   map[string]*execProcess
 
 	// spec is equivalent to config.json in the bundle
 	spec   *specs.Spec
 	mounts []*types.Mount
 	env    map[string]string
+	config *DomainConfig
 
-	client     *libvirt.Libvirt
+	client     libvirtClient
 	domainMeta libvirt.Domain
 	domain     *libvirtxml.Domain
 
@@ -53,17 +81,31 @@ type VM struct {
 	cancel context.CancelFunc
 }
 
+// ConnectLibvirt connects to the local libvirtd.
+func ConnectLibvirt() (*libvirt.Libvirt, error) {
+	client := libvirt.NewWithDialer(dialers.NewLocal(dialers.WithSocket("/opt/homebrew/var/run/libvirt/libvirt-sock")))
+	err := client.Connect()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to libvirtd")
+	}
+	return client, nil
+}
+
 func NewVM(
+	namespace string,
 	id string,
 	stdio stdio.Stdio,
 	spec *specs.Spec,
 	bundle string,
 	rootFS []*types.Mount,
 ) (*VM, error) {
-	client := libvirt.NewWithDialer(dialers.NewLocal(dialers.WithSocket("/opt/homebrew/var/run/libvirt/libvirt-sock")))
-	err := client.Connect()
+	config, err := NewDomainConfig(namespace, id, spec)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to libvirtd")
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid annotations: %v", err)
+	}
+	client, err := ConnectLibvirt()
+	if err != nil {
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -76,13 +118,17 @@ func NewVM(
 	}
 
 	vm := &VM{
-		id:     id,
-		stdio:  stdio,
-		spec:   spec,
-		bundle: bundle,
-		client: client,
-		mounts: rootFS,
-		env:    env,
+		namespace: namespace,
+		id:        id,
+		stdio:     stdio,
+		spec:      spec,
+		bundle:    bundle,
+		client:    client,
+		mounts:    rootFS,
+		env:       env,
+		config:    config,
+		execs:     make(map[string]*execProcess),
+		state:     StateCreated,
 
 		ctx:    ctx,
 		cancel: cancel,
@@ -98,11 +144,45 @@ func NewVM(
 // During a delete binary call, the shim MUST ensure that filesystem is also unmounted(empty).
 // Filesystems are provided by the containerd "native" snapshotters.
 func (v *VM) Init() error {
-	err := v.setupRootFS()
+	// Check host requirements before touching the bundle.
+	err := v.setupTPM()
+	if err != nil {
+		return err
+	}
+	err = v.setupAgent()
+	if err != nil {
+		return err
+	}
+	err = v.setupRootFS()
 	if err != nil {
 		return errors.Wrap(err, "failed to set up rootfs")
 	}
-	v.domain = RenderDomain(v.id, v.bundle)
+	err = v.setupVolumes()
+	if err != nil {
+		return errors.Wrap(err, "failed to set up disks")
+	}
+	err = v.setupFirmware()
+	if err != nil {
+		return errors.Wrap(err, "failed to set up firmware")
+	}
+	var resources *specs.LinuxResources
+	if v.spec.Linux != nil {
+		resources = v.spec.Linux.Resources
+	}
+	err = v.setupIOTune(resources)
+	if err != nil {
+		return errors.Wrap(err, "failed to set up I/O limits")
+	}
+	err = v.setupCloudInit()
+	if err != nil {
+		return errors.Wrap(err, "failed to set up cloud-init")
+	}
+	err = v.setupGraphics()
+	if err != nil {
+		return errors.Wrap(err, "failed to set up graphics")
+	}
+	v.config.Owner = newDomainOwner(v.namespace, v.id, v.bundle, v.spec.Annotations)
+	v.domain = RenderDomain(v.id, v.bundle, v.config)
 	xmlString, err := v.domain.Marshal()
 	if err != nil {
 		return err
@@ -115,14 +195,6 @@ func (v *VM) Init() error {
 	return nil
 }
 
-// QemuImageInfo represents the struct returned from `qemu-img info`.
-type QemuImageInfo struct {
-	Path        string `json:"-"`
-	VirtualSize uint64 `json:"virtual-size"`
-	Format      string `json:"format"`
-	DirtyFlag   bool   `json:"dirty-flag"`
-}
-
 // setupRootFS simulate mount by using symlinks,
 // as macOS doesn't have union-fs like feature, overlayfs or aufs snapshotters are not provided by containerd,
 // Snapshotter can be listed by `ctr plugins ls`.
@@ -135,68 +207,120 @@ type QemuImageInfo struct {
 //		  options:"rw",
 //	}
 func (v *VM) setupRootFS() error {
-	var bootImage string
-	var cloudinitImage string
+	var snapshotPath string
 	var imagePath string
 	for _, mount := range v.mounts {
 		// We ignore non-bind mounts since those are not relevant to VM.
 		if mount.Type != "bind" {
 			continue
 		}
+		snapshotPath = mount.Source
 		imagePath = filepath.Join(mount.Source, defaultRootImagePath)
-		bootImage = filepath.Join(imagePath, defaultRootImageFileName)
-		cloudinitImage = filepath.Join(imagePath, defaultCloudInitImageFileName)
 	}
-	if bootImage == "" {
+	if imagePath == "" {
 		return errors.Wrap(ErrInvalidImage, "no bind type mounts")
 	}
-	_, err := os.Stat(bootImage)
+	install := v.spec.Annotations[AnnotationInstallISO]
+	persistent := v.spec.Annotations[AnnotationRootDisk]
+	bootImage, err := findBootImage(imagePath)
 	if err != nil {
-		return err
+		// Installer images ship an ISO instead of a boot disk.
+		imageInstall := filepath.Join(imagePath, installImageFileName)
+		if _, statErr := os.Stat(imageInstall); statErr != nil {
+			return err
+		}
+		if install == "" {
+			install = imageInstall
+		}
+	}
+	if install != "" || persistent != "" {
+		err = v.linkImage(imagePath)
+		if err != nil {
+			return err
+		}
+		return v.setupInstall(install, persistent)
 	}
 	bootInfo, err := getImageInfo(bootImage)
 	if err != nil {
 		return err
 	}
-	if bootInfo.Format != "qcow2" {
-		return errors.Wrap(ErrInvalidImage, fmt.Sprintf("%v is not a qcow2 image", bootImage))
+	err = checkImageFormat(bootImage, bootInfo.Format)
+	if err != nil {
+		return err
 	}
-	_, err = os.Stat(cloudinitImage)
+	repaired, err := checkImageChain(bootImage, snapshotPath, v.spec.Annotations[AnnotationImageRepair], v.bundle)
 	if err != nil {
 		return err
 	}
-	return os.Symlink(imagePath, filepath.Join(v.bundle, "rootfs", defaultRootImagePath))
-}
-
-func getImageInfo(path string) (*QemuImageInfo, error) {
-	cmd := exec.Command("qemu-img", "info", path, "--output=json")
-	res, err := cmd.Output()
+	err = v.linkImage(imagePath)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to run qemu-img info at %v, err %v", path, cmd.Err.Error()))
+		return err
 	}
-	imageInfo := &QemuImageInfo{}
-	err = json.Unmarshal(res, imageInfo)
+	err = v.setupKernel(imagePath)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read qemu-img info")
+		return err
 	}
-
-	if imageInfo.Format == "" {
-		imageInfo.Format = "raw"
+	v.config.RootImage = filepath.Join(v.bundle, "rootfs", defaultRootImagePath, filepath.Base(bootImage))
+	if repaired != bootImage {
+		// The image is never written to, the copy is the container's.
+		v.config.RootImage, bootImage = repaired, repaired
 	}
+	v.config.RootFormat = bootInfo.Format
+	return v.setupRootDisk(bootImage, bootInfo)
+}
 
-	return imageInfo, nil
+// linkImage checks the image ships a cloud-init seed and links its disk
+// directory into the bundle.
+func (v *VM) linkImage(imagePath string) error {
+	cloudinitImage := filepath.Join(imagePath, defaultCloudInitImageFileName)
+	_, err := os.Stat(cloudinitImage)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(imagePath, filepath.Join(v.bundle, "rootfs", defaultRootImagePath))
 }
 
 func (v *VM) ID() string {
 	return v.id
 }
 
+// Stdio returns the stdio of the task.
+func (v *VM) Stdio() stdio.Stdio {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.stdio
+}
+
+// ExitedAt returns when the VM was seen stopped.
+func (v *VM) ExitedAt() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.exitedAt
+}
+
+// setKilled records the VM stopped by Kill, unless it was seen stopped
+// meanwhile.
+func (v *VM) setKilled(reason string) error {
+	var err error
+	v.mu.Lock()
+	v.stdio.Terminal = true
+	if v.state != StateStopped {
+		err = v.transitionLocked(StateStopped, reason)
+	}
+	v.mu.Unlock()
+	v.cancel()
+	return err
+}
+
 func (v *VM) Pid() uint32 {
-	if v.domain.Name == "" {
+	if v.domain == nil || v.domain.Name == "" {
 		return 0
 	}
-	if v.pid != 0 {
-		return uint32(v.pid)
+	v.mu.Lock()
+	cached := v.pid
+	v.mu.Unlock()
+	if cached != 0 {
+		return uint32(cached)
 	}
 
 	pidFile := fmt.Sprintf("/opt/homebrew/var/run/libvirt/qemu/%v.pid", v.domain.Name)
@@ -212,52 +336,195 @@ func (v *VM) Pid() uint32 {
 	if err != nil {
 		return 0
 	}
+	v.mu.Lock()
 	v.pid = pid
+	v.mu.Unlock()
 	return uint32(pid)
 }
 
 func (v *VM) Start(ctx context.Context) error {
-	err := v.client.DomainCreate(v.domainMeta)
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkTransition(StateRunning)
+	if err != nil {
+		return err
+	}
+	err = v.client.DomainCreate(v.domainMeta)
 	if err != nil {
 		return errors.Wrapf(err, "failed to start VM '%v'", v.domain.Name)
 	}
-	v.started = true
+	err = v.transition(StateRunning, "started")
+	if err != nil {
+		return err
+	}
+	err = v.watchGuard(v.ctx)
+	if err != nil {
+		logrus.WithError(err).Error("failed to watch watchdog and panic events")
+	}
+	err = v.recordGraphicsPort()
+	if err != nil {
+		logrus.WithError(err).Error("failed to record display port")
+	}
+	if v.config.ScreenshotOnTimeout {
+		go v.waitReady()
+	}
 	return nil
 }
 
+// waitReady waits for the agent after Start, so that a guest hanging in
+// its firmware or early boot is caught without waiting for an exec.
+func (v *VM) waitReady() {
+	if _, err := v.waitAgent(v.ctx); err != nil && v.ctx.Err() == nil {
+		logrus.WithError(err).Warn("VM not ready in time")
+	}
+}
+
 func (v *VM) Delete(ctx context.Context, opts ...containerd.ProcessDeleteOpts) (*containerd.ExitStatus, error) {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	// Catch up with a guest that powered off.
+	if _, err := v.Status(ctx); err != nil {
+		logrus.WithError(err).Warn("failed to get VM state")
+	}
+	err := v.checkTransition(StateDeleted)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		removeErr := os.Remove(filepath.Join(v.bundle, "rootfs", defaultRootImagePath))
 		if removeErr != nil {
 			logrus.WithError(removeErr).Error("failed to remove image path")
 		}
 	}()
-	err := v.client.DomainUndefineFlags(v.domainMeta, libvirt.DomainUndefineNvram)
-	if err != nil && !libvirt.IsNotFound(err) {
-		return containerd.NewExitStatus(1, v.exitedAt, err), nil
+	exitedAt := v.ExitedAt()
+	// The install is done when the guest powered off by itself, even if
+	// nobody waited for it to finish it.
+	installed := false
+	// The domain isn't defined when Init failed.
+	if v.domainMeta.Name != "" {
+		installed = v.poweredOffByGuest()
+		// Make sure QEMU is gone so that attached disks are released
+		// before the domain is undefined.
+		err = v.client.DomainDestroy(v.domainMeta)
+		if err != nil && !libvirt.IsNotFound(err) && !isNotRunning(err) {
+			return containerd.NewExitStatus(1, exitedAt, err), nil
+		}
+		err = v.removeSnapshots()
+		if err != nil {
+			logrus.WithError(err).Error("failed to remove snapshots")
+		}
+	}
+	if !installed {
+		err = v.removeUnfinishedInstall()
+		if err != nil {
+			logrus.WithError(err).Error("failed to remove disk of unfinished install")
+		}
+	}
+	if v.domainMeta.Name != "" {
+		undefineFlags := libvirt.DomainUndefineNvram | libvirt.DomainUndefineSnapshotsMetadata
+		if v.config.Firmware.NVRAMName != "" {
+			undefineFlags = libvirt.DomainUndefineKeepNvram | libvirt.DomainUndefineSnapshotsMetadata
+		}
+		err = v.client.DomainUndefineFlags(v.domainMeta, undefineFlags)
+		if err != nil && !libvirt.IsNotFound(err) {
+			return containerd.NewExitStatus(1, exitedAt, err), nil
+		}
+	}
+	err = v.removeTPMState()
+	if err != nil {
+		logrus.WithError(err).Error("failed to remove TPM state")
+	}
+	err = v.removeAgentSocket()
+	if err != nil {
+		logrus.WithError(err).Error("failed to remove agent socket")
+	}
+	err = v.removeGraphics()
+	if err != nil {
+		logrus.WithError(err).Error("failed to remove display socket")
+	}
+	err = v.unlockDisk()
+	if err != nil {
+		logrus.WithError(err).Error("failed to unlock persistent disk")
+	}
+	err = v.transition(StateDeleted, "deleted")
+	if err != nil {
+		return nil, err
+	}
+	v.cancel()
+	err = v.client.Disconnect()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to disconnect from libvirtd")
 	}
-	return containerd.NewExitStatus(0, v.exitedAt, nil), nil
+	return containerd.NewExitStatus(0, exitedAt, nil), nil
 }
 
 func (v *VM) Kill(ctx context.Context, signal syscall.Signal, opts ...containerd.KillOpts) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	state := v.State()
+	switch state {
+	case StateStopped, StateDeleted:
+		// As for a process that already exited.
+		return errors.Wrapf(errdefs.ErrNotFound, "VM %v is %v", v.id, state)
+	case StateRunning, StatePaused:
+		if signal == syscall.SIGTERM && v.config.Agent.Enabled {
+			// Let the guest shut down, Wait sees the VM stopped afterwards.
+			v.killed.Store(true)
+			err := v.Shutdown(ctx)
+			if err == nil {
+				return v.transition(StateStopping, "guest shutdown")
+			}
+			logrus.WithError(err).Warn("failed to shut down guest, stopping VM")
+		}
+	case StateStopping:
+		if signal == syscall.SIGTERM {
+			// Already shutting down.
+			return nil
+		}
+	}
+	v.killed.Store(true)
 	err := v.client.DomainDestroy(v.domainMeta)
 	if err != nil {
-		if libvirt.IsNotFound(err) || strings.Contains(err.Error(), "is not running") {
+		if libvirt.IsNotFound(err) || isNotRunning(err) {
 			// Already stopped.
-			v.stdio.Terminal = true
-			v.exitedAt = time.Now()
-			v.exited = true
-			v.cancel()
-			return nil
+			return v.setKilled("killed, not running")
 		}
 		logrus.WithError(err).Error("failed to destroy domain")
 		return errors.Wrapf(err, "failed to stop VM '%v'", v.domain.Name)
 	}
-	v.stdio.Terminal = true
-	v.exitedAt = time.Now()
-	v.exited = true
-	v.cancel()
-	return nil
+	return v.setKilled(fmt.Sprintf("killed by %v", signal))
+}
+
+func (v *VM) Pause(ctx context.Context) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	err := v.checkTransition(StatePaused)
+	if err != nil {
+		return err
+	}
+	err = v.client.DomainSuspend(v.domainMeta)
+	if err != nil {
+		return errors.Wrapf(err, "failed to pause VM '%v'", v.domain.Name)
+	}
+	return v.transition(StatePaused, "paused")
+}
+
+func (v *VM) Resume(ctx context.Context) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	// Only paused VMs resume, not stopping ones.
+	if state := v.State(); state != StatePaused {
+		return v.transitionError(state, StateRunning)
+	}
+	err := v.client.DomainResume(v.domainMeta)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resume VM '%v'", v.domain.Name)
+	}
+	return v.transition(StateRunning, "resumed")
+}
+
+func isNotRunning(err error) bool {
+	return strings.Contains(err.Error(), "is not running")
 }
 
 func (v *VM) Wait(ctx context.Context) (<-chan containerd.ExitStatus, error) {
@@ -271,6 +538,13 @@ func (v *VM) Wait(ctx context.Context) (<-chan containerd.ExitStatus, error) {
 				status, err := v.Status(ctx)
 				if err == nil && status.Status == containerd.Stopped {
 					ticker.Stop()
+					v.waitGuard(ctx)
+					// An installer is done when the guest powered off by itself.
+					if v.poweredOffByGuest() {
+						if err := v.finishInstall(); err != nil {
+							logrus.WithError(err).Error("failed to finish install")
+						}
+					}
 					cancel()
 					return
 				}
@@ -289,8 +563,7 @@ func (v *VM) Wait(ctx context.Context) (<-chan containerd.ExitStatus, error) {
 		}
 	}()
 	<-ctx.Done()
-	// Always exit with 0.
-	exitChan <- *containerd.NewExitStatus(0, time.Now(), nil)
+	exitChan <- *containerd.NewExitStatus(v.exitCode.Load(), v.ExitedAt(), nil)
 	return exitChan, nil
 }
 
@@ -309,20 +582,22 @@ func (v *VM) IO() cio.IO {
 	panic("implement me")
 }
 
+// Status returns the status of the VM, following the changes made behind
+// the shim to its lifecycle state.
 func (v *VM) Status(ctx context.Context) (containerd.Status, error) {
-	if !v.started {
+	switch v.State() {
+	case StateCreated:
 		return containerd.Status{
 			Status: containerd.Created,
 		}, nil
+	case StateStopped, StateDeleted:
+		return containerd.Status{
+			Status: containerd.Stopped,
+		}, nil
 	}
 
 	pid := v.Pid()
 	if pid == 0 {
-		if v.exited {
-			return containerd.Status{
-				Status: containerd.Stopped,
-			}, nil
-		}
 		return containerd.Status{
 			Status: containerd.Unknown,
 		}, nil
@@ -341,11 +616,6 @@ func (v *VM) Status(ctx context.Context) (containerd.Status, error) {
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			// Domain is probably removed.
-			if v.exited {
-				return containerd.Status{
-					Status: containerd.Stopped,
-				}, nil
-			}
 			return containerd.Status{
 				Status: containerd.Unknown,
 			}, nil
@@ -360,10 +630,12 @@ func (v *VM) Status(ctx context.Context) (containerd.Status, error) {
 			Status: containerd.Created,
 		}, nil
 	case 1: // Running.
+		v.observe(StateRunning, "resumed behind the shim")
 		return containerd.Status{
 			Status: containerd.Running,
 		}, nil
 	case 3, 7: // Paused, suspended.
+		v.observe(StatePaused, "paused behind the shim")
 		return containerd.Status{
 			Status: containerd.Paused,
 		}, nil
@@ -373,6 +645,7 @@ func (v *VM) Status(ctx context.Context) (containerd.Status, error) {
 		}, nil
 	case 5, 6: // Shut off, crashed.
 		// Special handling for preserving shim if needed.
+		v.observe(StateStopped, "domain shut off")
 		return containerd.Status{
 			Status: containerd.Stopped,
 		}, nil
@@ -0,0 +1,297 @@
+package hvf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/process"
+	"github.com/digitalocean/go-libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// fakeLibvirt keeps the state of a single domain. Methods VMs don't call
+// in these tests are left to the embedded nil interface.
+type fakeLibvirt struct {
+	libvirtClient
+
+	mu      sync.Mutex
+	state   libvirt.DomainState
+	reason  int32
+	defined bool
+	ioTunes int
+	events  map[libvirt.DomainEventID]chan interface{}
+}
+
+func newFakeLibvirt(state libvirt.DomainState) *fakeLibvirt {
+	return &fakeLibvirt{state: state, defined: true}
+}
+
+func (f *fakeLibvirt) DomainCreate(dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = libvirt.DomainRunning
+	return nil
+}
+
+func (f *fakeLibvirt) DomainDestroy(dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state != libvirt.DomainRunning && f.state != libvirt.DomainPaused {
+		return fmt.Errorf("Requested operation is not valid: domain is not running")
+	}
+	f.state, f.reason = libvirt.DomainShutoff, int32(libvirt.DomainShutoffDestroyed)
+	return nil
+}
+
+func (f *fakeLibvirt) DomainSuspend(dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = libvirt.DomainPaused
+	return nil
+}
+
+func (f *fakeLibvirt) DomainResume(dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = libvirt.DomainRunning
+	return nil
+}
+
+func (f *fakeLibvirt) DomainGetState(dom libvirt.Domain, flags uint32) (int32, int32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.defined {
+		return 0, 0, fmt.Errorf("Domain not found: no domain with matching name '%v'", dom.Name)
+	}
+	return int32(f.state), f.reason, nil
+}
+
+func (f *fakeLibvirt) DomainUndefineFlags(dom libvirt.Domain, flags libvirt.DomainUndefineFlagsValues) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defined = false
+	return nil
+}
+
+func (f *fakeLibvirt) DomainListAllSnapshots(dom libvirt.Domain, needResults int32, flags uint32) ([]libvirt.DomainSnapshot, int32, error) {
+	return nil, 0, nil
+}
+
+func (f *fakeLibvirt) DomainSnapshotLookupByName(dom libvirt.Domain, name string, flags uint32) (libvirt.DomainSnapshot, error) {
+	return libvirt.DomainSnapshot{Name: name, Dom: dom}, nil
+}
+
+func (f *fakeLibvirt) DomainRevertToSnapshot(snap libvirt.DomainSnapshot, flags uint32) error {
+	return nil
+}
+
+func (f *fakeLibvirt) DomainSetBlockIOTune(dom libvirt.Domain, disk string, params []libvirt.TypedParam, flags uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ioTunes++
+	return nil
+}
+
+func (f *fakeLibvirt) ioTuneCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ioTunes
+}
+
+// SubscribeEvents returns the channel tests send events of eventID to.
+func (f *fakeLibvirt) SubscribeEvents(ctx context.Context, eventID libvirt.DomainEventID, dom libvirt.OptDomain) (<-chan interface{}, error) {
+	return f.eventChan(eventID), nil
+}
+
+func (f *fakeLibvirt) eventChan(eventID libvirt.DomainEventID) chan interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.events == nil {
+		f.events = make(map[libvirt.DomainEventID]chan interface{})
+	}
+	if f.events[eventID] == nil {
+		f.events[eventID] = make(chan interface{}, 16)
+	}
+	return f.events[eventID]
+}
+
+func (f *fakeLibvirt) Disconnect() error {
+	return nil
+}
+
+// newTestVM returns a running VM backed by client.
+func newTestVM(t *testing.T, client libvirtClient) *VM {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &VM{
+		namespace:  "default",
+		id:         "test",
+		bundle:     t.TempDir(),
+		pid:        1,
+		state:      StateRunning,
+		config:     &DomainConfig{},
+		execs:      make(map[string]*execProcess),
+		client:     client,
+		domainMeta: libvirt.Domain{Name: "default_test"},
+		domain:     &libvirtxml.Domain{Name: "default_test"},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// newTestService returns a task service serving vm, dropping its events.
+func newTestService(t *testing.T, vm *VM) *TaskService {
+	s := &TaskService{
+		namespace: "default",
+		events:    make(chan interface{}, 128),
+		cancel:    func() {},
+		processes: make(map[string]process.Process),
+		vm:        make(map[string]*VM),
+	}
+	if vm != nil {
+		s.vm[vm.ID()] = vm
+		vm.events = s.send
+	}
+	go func() {
+		for range s.events {
+		}
+	}()
+	t.Cleanup(func() {
+		_, _ = s.Shutdown(context.Background(), &task.ShutdownRequest{})
+	})
+	return s
+}
+
+func TestConcurrentLifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	vm := newTestVM(t, newFakeLibvirt(libvirt.DomainRunning))
+	s := newTestService(t, vm)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	var waitResp *task.WaitResponse
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := s.Wait(ctx, &task.WaitRequest{ID: vm.ID()})
+		if err != nil {
+			errs <- fmt.Errorf("wait: %w", err)
+		}
+		waitResp = resp
+	}()
+	for _, signal := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL, syscall.SIGKILL, syscall.SIGTERM} {
+		wg.Add(1)
+		go func(signal syscall.Signal) {
+			defer wg.Done()
+			_, err := s.Kill(ctx, &task.KillRequest{ID: vm.ID(), Signal: uint32(signal)})
+			// Kills racing with one that stopped the VM find it gone.
+			if err != nil && !errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+				errs <- fmt.Errorf("kill %v: %w", signal, err)
+			}
+		}(signal)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := s.State(ctx, &task.StateRequest{ID: vm.ID()}); err != nil {
+					errs <- fmt.Errorf("state: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				_, err := s.Delete(ctx, &task.DeleteRequest{ID: vm.ID()})
+				err = errdefs.FromGRPC(err)
+				switch {
+				case err == nil, errdefs.IsNotFound(err):
+					// Deleted, by this or the other goroutine.
+					return
+				case errdefs.IsFailedPrecondition(err):
+					// Not stopped yet.
+					time.Sleep(10 * time.Millisecond)
+				default:
+					errs <- fmt.Errorf("delete: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if state := vm.State(); state != StateDeleted {
+		t.Fatalf("VM is %v, expected %v", state, StateDeleted)
+	}
+	if waitResp == nil || !waitResp.ExitedAt.AsTime().Equal(vm.ExitedAt()) {
+		t.Errorf("Wait returned %v, expected the VM exit time %v", waitResp, vm.ExitedAt())
+	}
+	previous := StateRunning
+	for _, transition := range vm.Transitions() {
+		if transition.From != previous || !canTransition(transition.From, transition.To) {
+			t.Errorf("unexpected transition %v", transition)
+		}
+		previous = transition.To
+	}
+}
+
+func TestConcurrentSendAndShutdown(t *testing.T) {
+	s := newTestService(t, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.send(&struct{}{})
+			}
+		}()
+	}
+	_, err := s.Shutdown(context.Background(), &task.ShutdownRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestGetVMBeingCreated(t *testing.T) {
+	s := newTestService(t, nil)
+	s.vm["test"] = nil
+	_, err := s.getVM("test")
+	if !errdefs.IsUnavailable(errdefs.FromGRPC(err)) {
+		t.Errorf("getVM returned %v, expected unavailable", err)
+	}
+	_, err = s.getVM("missing")
+	if !errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+		t.Errorf("getVM returned %v, expected not found", err)
+	}
+}
+
+func TestKillStopped(t *testing.T) {
+	v := newTestVM(t, newFakeLibvirt(libvirt.DomainShutoff))
+	v.state = StateStopped
+	err := v.Kill(context.Background(), syscall.SIGKILL)
+	if !errdefs.IsNotFound(err) {
+		t.Errorf("kill of a stopped VM: got %v, expected not found", err)
+	}
+	// A late kill doesn't make a guest that powered off look killed.
+	if v.killed.Load() {
+		t.Error("kill of a stopped VM marked it killed")
+	}
+}
@@ -0,0 +1,216 @@
+package hvf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"libvirt.org/go/libvirtxml"
+)
+
+// MountTypeDisk marks a mount of spec.Mounts as an extra disk rather than a
+// shared directory, e.g.
+//
+//	ctr run --mount type=hvf-disk,src=/path/data.qcow2,dst=/data,options=ro:cache=none ...
+const MountTypeDisk = "hvf-disk"
+
+// Volume is an extra virtio disk attached to the VM.
+type Volume struct {
+	Name   string
+	Source string
+	// Block is set when Source is a host block device rather than an image.
+	Block    bool
+	Format   string
+	ReadOnly bool
+	Cache    string
+	IO       string
+	// Serial lets the guest find the disk as /dev/disk/by-id/virtio-<serial>.
+	Serial string
+	IOTune DiskIOTune
+}
+
+// virtio-blk serials are limited to 20 bytes.
+var validSerial = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+
+// parseVolumes reads extra disks from hvf-disk mounts and annotations.
+func parseVolumes(spec *specs.Spec) ([]Volume, error) {
+	var volumes []Volume
+	for _, m := range spec.Mounts {
+		if m.Type != MountTypeDisk {
+			continue
+		}
+		conf := map[string]string{"source": m.Source}
+		for _, o := range m.Options {
+			key, value, _ := strings.Cut(o, "=")
+			switch key {
+			case "ro":
+				conf["readonly"] = "true"
+			case "rw":
+				conf["readonly"] = "false"
+			default:
+				conf[key] = value
+			}
+		}
+		volume, err := parseVolume(filepath.Base(m.Destination), conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mount %v", m.Destination)
+		}
+		volumes = append(volumes, volume)
+	}
+
+	named := namedAnnotations(spec.Annotations, AnnotationVolumePrefix)
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		volume, err := parseVolume(name, named[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "disk %v", name)
+		}
+		volumes = append(volumes, volume)
+	}
+
+	serials := make(map[string]bool, len(volumes))
+	for _, volume := range volumes {
+		if serials[volume.Serial] {
+			return nil, fmt.Errorf("duplicated disk serial %q", volume.Serial)
+		}
+		serials[volume.Serial] = true
+	}
+	return volumes, nil
+}
+
+func parseVolume(name string, conf map[string]string) (Volume, error) {
+	volume := Volume{
+		Name:   name,
+		Source: conf["source"],
+		Format: conf["format"],
+		Cache:  conf["cache"],
+		IO:     conf["io"],
+		Serial: conf["serial"],
+	}
+	if volume.Source == "" {
+		return volume, fmt.Errorf("no source")
+	}
+	if !filepath.IsAbs(volume.Source) {
+		return volume, fmt.Errorf("source %q is not absolute", volume.Source)
+	}
+	if readOnly := conf["readonly"]; readOnly != "" {
+		b, err := strconv.ParseBool(readOnly)
+		if err != nil {
+			return volume, fmt.Errorf("invalid readonly %q", readOnly)
+		}
+		volume.ReadOnly = b
+	}
+	switch volume.Cache {
+	case "", "none", "writeback", "writethrough", "directsync", "unsafe":
+	default:
+		return volume, fmt.Errorf("unsupported cache mode %q", volume.Cache)
+	}
+	switch volume.IO {
+	case "", "threads", "io_uring":
+	case "native":
+		// Asynchronous IO bypasses the host page cache.
+		if volume.Cache != "none" && volume.Cache != "directsync" {
+			return volume, fmt.Errorf("io=native requires cache=none or cache=directsync")
+		}
+	default:
+		return volume, fmt.Errorf("unsupported io mode %q", volume.IO)
+	}
+	if volume.Serial == "" {
+		volume.Serial = name
+	}
+	if !validSerial.MatchString(volume.Serial) {
+		return volume, fmt.Errorf("invalid serial %q, expect at most 20 of [A-Za-z0-9_-]", volume.Serial)
+	}
+	return volume, nil
+}
+
+// setupVolumes checks the sources of volumes and detects image formats.
+func (v *VM) setupVolumes() error {
+	for i := range v.config.Volumes {
+		volume := &v.config.Volumes[i]
+		stat, err := os.Stat(volume.Source)
+		if err != nil {
+			return errors.Wrapf(err, "disk %v", volume.Name)
+		}
+		switch {
+		case stat.Mode()&os.ModeDevice != 0:
+			volume.Block = true
+			if volume.Format == "" {
+				volume.Format = "raw"
+			}
+		case stat.Mode().IsRegular():
+			info, err := getImageInfo(volume.Source)
+			if err != nil {
+				return errors.Wrapf(err, "disk %v", volume.Name)
+			}
+			if volume.Format != "" && volume.Format != info.Format {
+				return errors.Wrapf(ErrInvalidImage, "disk %v is %v, not %v", volume.Name, info.Format, volume.Format)
+			}
+			volume.Format = info.Format
+		default:
+			return errors.Wrapf(ErrInvalidImage, "disk %v: %v is neither an image nor a block device", volume.Name, volume.Source)
+		}
+	}
+	return nil
+}
+
+func renderVolumes(dom *libvirtxml.Domain, volumes []Volume) {
+	for _, volume := range volumes {
+		disk := libvirtxml.DomainDisk{
+			Device: "disk",
+			Driver: &libvirtxml.DomainDiskDriver{
+				Name:  "qemu",
+				Type:  volume.Format,
+				Cache: volume.Cache,
+				IO:    volume.IO,
+			},
+			Source: &libvirtxml.DomainDiskSource{},
+			Target: &libvirtxml.DomainDiskTarget{Dev: nextVirtioDisk(dom), Bus: "virtio"},
+			Serial: volume.Serial,
+			IOTune: volume.IOTune.libvirt(),
+		}
+		if volume.Block {
+			disk.Source.Block = &libvirtxml.DomainDiskSourceBlock{Dev: volume.Source}
+		} else {
+			disk.Source.File = &libvirtxml.DomainDiskSourceFile{File: volume.Source}
+		}
+		if volume.ReadOnly {
+			disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+		}
+		dom.Devices.Disks = append(dom.Devices.Disks, disk)
+	}
+}
+
+// nextVirtioDisk returns the first unused vdX target name.
+func nextVirtioDisk(dom *libvirtxml.Domain) string {
+	used := make(map[string]bool, len(dom.Devices.Disks))
+	for _, disk := range dom.Devices.Disks {
+		if disk.Target != nil {
+			used[disk.Target.Dev] = true
+		}
+	}
+	for i := 0; ; i++ {
+		dev := "vd" + diskSuffix(i)
+		if !used[dev] {
+			return dev
+		}
+	}
+}
+
+// diskSuffix returns a, b, ..., z, aa, ab, ... like the kernel does.
+func diskSuffix(i int) string {
+	if i < 26 {
+		return string(rune('a' + i))
+	}
+	return diskSuffix(i/26-1) + string(rune('a'+i%26))
+}
@@ -0,0 +1,231 @@
+package hvf
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"containerd-hvf/pkg/api"
+	"github.com/containerd/containerd/api/events"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Actions taken when the guest watchdog expires or the guest panics.
+const (
+	GuardActionNone     = "none"
+	GuardActionReset    = "reset"
+	GuardActionPoweroff = "poweroff"
+	GuardActionPause    = "pause"
+)
+
+// Exit codes of VMs stopped by their watchdog or a panic, like processes
+// killed by SIGALRM and SIGABRT.
+const (
+	ExitCodeWatchdog = 128 + 14
+	ExitCodePanic    = 128 + 6
+)
+
+// guardEventTimeout bounds how long Wait waits for the events of a stopped
+// domain to be handled, in case libvirt never sends them.
+const guardEventTimeout = 5 * time.Second
+
+// Topics of the events published besides the task ones.
+const (
+	TopicWatchdog = "/hvf/watchdog"
+	TopicPanic    = "/hvf/panic"
+)
+
+// GuardConfig selects the devices helping to detect and recover hung or
+// crashed guests.
+type GuardConfig struct {
+	RNG      bool
+	Watchdog string
+	Panic    string
+}
+
+func parseGuard(annotations map[string]string) (GuardConfig, error) {
+	conf := GuardConfig{RNG: true, Watchdog: GuardActionReset, Panic: GuardActionReset}
+	if value, ok := annotations[AnnotationRNG]; ok {
+		rng, err := strconv.ParseBool(value)
+		if err != nil {
+			return conf, fmt.Errorf("invalid %v %q", AnnotationRNG, value)
+		}
+		conf.RNG = rng
+	}
+	if value, ok := annotations[AnnotationWatchdog]; ok {
+		switch value {
+		case GuardActionNone, GuardActionReset, GuardActionPoweroff, GuardActionPause:
+			conf.Watchdog = value
+		default:
+			return conf, fmt.Errorf("invalid %v %q, expect none, reset, poweroff or pause", AnnotationWatchdog, value)
+		}
+	}
+	if value, ok := annotations[AnnotationPanic]; ok {
+		switch value {
+		case GuardActionNone, GuardActionReset, GuardActionPoweroff:
+			conf.Panic = value
+		default:
+			return conf, fmt.Errorf("invalid %v %q, expect none, reset or poweroff", AnnotationPanic, value)
+		}
+	}
+	return conf, nil
+}
+
+// renderGuard adds a virtio-rng fed by the host, an i6300esb watchdog and
+// a pvpanic device. A watchdog is only armed by a daemon in the guest.
+func renderGuard(dom *libvirtxml.Domain, conf GuardConfig) {
+	if conf.RNG {
+		dom.Devices.RNGs = append(dom.Devices.RNGs, libvirtxml.DomainRNG{
+			Model: "virtio",
+			Backend: &libvirtxml.DomainRNGBackend{
+				Random: &libvirtxml.DomainRNGBackendRandom{Device: "/dev/urandom"},
+			},
+		})
+	}
+	if conf.Watchdog != GuardActionNone {
+		dom.Devices.Watchdogs = append(dom.Devices.Watchdogs, libvirtxml.DomainWatchdog{
+			Model:  "i6300esb",
+			Action: conf.Watchdog,
+		})
+	}
+	if conf.Panic != GuardActionNone {
+		dom.Devices.Panics = append(dom.Devices.Panics, libvirtxml.DomainPanic{Model: "pvpanic"})
+		dom.OnCrash = "restart"
+		if conf.Panic == GuardActionPoweroff {
+			dom.OnCrash = "destroy"
+		}
+	}
+}
+
+// watchGuard turns watchdog and panic events of the domain into task
+// events and exit codes, until ctx is done.
+func (v *VM) watchGuard(ctx context.Context) error {
+	if v.config.Guard.Watchdog == GuardActionNone && v.config.Guard.Panic == GuardActionNone {
+		return nil
+	}
+	watchdog, err := v.client.SubscribeEvents(ctx, libvirt.DomainEventIDWatchdog, nil)
+	if err != nil {
+		return err
+	}
+	lifecycle, err := v.client.SubscribeEvents(ctx, libvirt.DomainEventIDLifecycle, nil)
+	if err != nil {
+		return err
+	}
+	stopped := make(chan struct{})
+	var once sync.Once
+	v.mu.Lock()
+	v.guardStopped = stopped
+	v.mu.Unlock()
+	onWatchdog := func(e interface{}) {
+		if msg, ok := e.(*libvirt.DomainEventCallbackWatchdogMsg); ok && msg.Msg.Dom.UUID == v.domainMeta.UUID {
+			v.onWatchdog()
+		}
+	}
+	go func() {
+		for watchdog != nil || lifecycle != nil {
+			select {
+			case e, ok := <-watchdog:
+				if !ok {
+					watchdog = nil
+					continue
+				}
+				onWatchdog(e)
+			case e, ok := <-lifecycle:
+				if !ok {
+					lifecycle = nil
+					continue
+				}
+				msg, ok := e.(*libvirt.DomainEventCallbackLifecycleMsg)
+				if !ok || msg.Msg.Dom.UUID != v.domainMeta.UUID {
+					continue
+				}
+				switch {
+				case msg.Msg.Event == int32(libvirt.DomainEventCrashed) && msg.Msg.Detail == int32(libvirt.DomainEventCrashedPanicked):
+					v.onPanic()
+				case msg.Msg.Event == int32(libvirt.DomainEventStopped):
+					// The watchdog event is sent before the domain stops,
+					// handle it if it's still queued.
+					for drained := false; !drained && watchdog != nil; {
+						select {
+						case e, ok := <-watchdog:
+							if !ok {
+								watchdog = nil
+								continue
+							}
+							onWatchdog(e)
+						default:
+							drained = true
+						}
+					}
+					once.Do(func() { close(stopped) })
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// waitGuard waits for the guard events of a stopped domain to be handled,
+// so that its exit code is known.
+func (v *VM) waitGuard(ctx context.Context) {
+	v.mu.Lock()
+	stopped := v.guardStopped
+	v.mu.Unlock()
+	if stopped == nil {
+		return
+	}
+	timer := time.NewTimer(guardEventTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-v.ctx.Done():
+	case <-ctx.Done():
+	case <-timer.C:
+		logrus.Warn("no stop event from libvirt, exit code may be missing")
+	}
+}
+
+func (v *VM) onWatchdog() {
+	action := v.config.Guard.Watchdog
+	logrus.WithField("action", action).Warn("guest watchdog expired")
+	v.recordGuardAction(action, ExitCodeWatchdog)
+	v.publish(&api.WatchdogFired{ContainerId: v.id, Action: action, FiredAt: timestamppb.Now()})
+}
+
+func (v *VM) onPanic() {
+	action := v.config.Guard.Panic
+	logrus.WithField("action", action).Warn("guest panicked")
+	v.recordGuardAction(action, ExitCodePanic)
+	v.publish(&api.GuestPanicked{ContainerId: v.id, Action: action, PanickedAt: timestamppb.Now()})
+}
+
+// recordGuardAction keeps the exit code of a VM stopped by action, and
+// reports VMs stopped or paused by it.
+func (v *VM) recordGuardAction(action string, exitCode uint32) {
+	switch action {
+	case GuardActionPoweroff:
+		v.exitCode.Store(exitCode)
+		v.observe(StateStopped, "stopped by guard")
+		v.publish(&events.TaskExit{
+			ContainerID: v.id,
+			ID:          v.id,
+			Pid:         v.Pid(),
+			ExitStatus:  exitCode,
+			ExitedAt:    timestamppb.New(v.ExitedAt()),
+		})
+	case GuardActionPause:
+		v.observe(StatePaused, "paused by guard")
+		v.publish(&events.TaskPaused{ContainerID: v.id})
+	}
+}
+
+func (v *VM) publish(evt interface{}) {
+	if v.events != nil {
+		v.events(evt)
+	}
+}
@@ -0,0 +1,64 @@
+package hvf
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/events"
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestWatchdogPoweroff(t *testing.T) {
+	fake := newFakeLibvirt(libvirt.DomainRunning)
+	v := newTestVM(t, fake)
+	v.config.Guard = GuardConfig{Watchdog: GuardActionPoweroff, Panic: GuardActionNone}
+	var mu sync.Mutex
+	var exits []*events.TaskExit
+	v.events = func(evt interface{}) {
+		if exit, ok := evt.(*events.TaskExit); ok {
+			mu.Lock()
+			exits = append(exits, exit)
+			mu.Unlock()
+		}
+	}
+	if err := v.watchGuard(v.ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait sees the domain shut off before the events are handled.
+	fake.mu.Lock()
+	fake.state, fake.reason = libvirt.DomainShutoff, int32(libvirt.DomainShutoffShutdown)
+	fake.mu.Unlock()
+	exitCh := make(chan uint32, 1)
+	go func() {
+		ch, err := v.Wait(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		exitCh <- (<-ch).ExitCode()
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	fake.eventChan(libvirt.DomainEventIDWatchdog) <- &libvirt.DomainEventCallbackWatchdogMsg{
+		Msg: libvirt.DomainEventWatchdogMsg{Dom: v.domainMeta},
+	}
+	fake.eventChan(libvirt.DomainEventIDLifecycle) <- &libvirt.DomainEventCallbackLifecycleMsg{
+		Msg: libvirt.DomainEventLifecycleMsg{Dom: v.domainMeta, Event: int32(libvirt.DomainEventStopped)},
+	}
+
+	select {
+	case code := <-exitCh:
+		if code != ExitCodeWatchdog {
+			t.Errorf("Wait returned exit code %v, expected %v", code, ExitCodeWatchdog)
+		}
+	case <-time.After(guardEventTimeout):
+		t.Fatal("Wait didn't return")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exits) != 1 || exits[0].ExitStatus != ExitCodeWatchdog || exits[0].ID != v.ID() {
+		t.Errorf("published %v, expected a task exit with the watchdog exit code", exits)
+	}
+}
@@ -0,0 +1,113 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"meta-data":      []byte("instance-id: test\n"),
+		"user-data":      []byte("#cloud-config\n"),
+		"network-config": bytes.Repeat([]byte("x"), 3*sectorSize+1),
+		"empty":          {},
+		// Names ISO9660 identifiers can't hold, only kept by Joliet.
+		"Mixed.Case.name": []byte("mixed"),
+		"unicodé ✓":       []byte("unicode"),
+	}
+	buf := &bytes.Buffer{}
+	if err := Write(buf, "cidata", files); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("read %v files, expected %v", names(got), names(files))
+	}
+}
+
+func TestRockRidgeNames(t *testing.T) {
+	data := []byte("#cloud-config\n")
+	image := rockRidgeImage("vendor-data", data)
+	got, err := Read(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, map[string][]byte{"vendor-data": data}) {
+		t.Errorf("read %v, expected vendor-data", names(got))
+	}
+}
+
+func TestMalformedImages(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Write(buf, "cidata", map[string][]byte{"user-data": bytes.Repeat([]byte("x"), 100)}); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	garbage := make([]byte, len(valid))
+	rand.New(rand.NewSource(1)).Read(garbage)
+
+	// A root directory claiming 4 GiB in an image of a few sectors.
+	hugeRoot := append([]byte(nil), valid...)
+	for _, sector := range []int{firstDescriptorSector, firstDescriptorSector + 1} {
+		binary.LittleEndian.PutUint32(hugeRoot[sector*sectorSize+156+10:], 0xffffffff)
+	}
+	// A file claiming 4 GiB.
+	hugeFile := rockRidgeImage("user-data", []byte("x"))
+	binary.LittleEndian.PutUint32(hugeFile[18*sectorSize+2*34+10:], 0xffffffff)
+
+	tests := map[string][]byte{
+		"empty":            {},
+		"system area only": valid[:firstDescriptorSector*sectorSize],
+		"no terminator":    valid[:(firstDescriptorSector+2)*sectorSize],
+		"no directories":   valid[:(firstDescriptorSector+4)*sectorSize],
+		"truncated data":   valid[:len(valid)-sectorSize],
+		"garbage":          garbage,
+		"huge root":        hugeRoot,
+		"huge file":        hugeFile,
+	}
+	for name, image := range tests {
+		if _, err := Read(bytes.NewReader(image), int64(len(image))); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+// rockRidgeImage builds an image without Joliet volume, holding a single
+// file named by a Rock Ridge NM entry: descriptors at sectors 16 and 17,
+// the root directory at 18 and the data at 19.
+func rockRidgeImage(name string, data []byte) []byte {
+	now := time.Now()
+	image := make([]byte, 20*sectorSize)
+	copy(image[16*sectorSize:], volumeDescriptor(1, "cidata", 20, 0, 0, 18, sectorSize, now))
+	image[17*sectorSize] = 255
+	copy(image[17*sectorSize+1:], standardIdentifier)
+
+	record := directoryRecord([]byte("FILE.;1"), 19, uint32(len(data)), false, now)
+	record = append(record, 'N', 'M', byte(5+len(name)), 1, 0)
+	record = append(record, name...)
+	if len(record)%2 == 1 {
+		record = append(record, 0)
+	}
+	record[0] = byte(len(record))
+	dir := directoryRecord([]byte{0}, 18, sectorSize, true, now)
+	dir = append(dir, directoryRecord([]byte{1}, 18, sectorSize, true, now)...)
+	dir = append(dir, record...)
+	copy(image[18*sectorSize:], dir)
+	copy(image[19*sectorSize:], data)
+	return image
+}
+
+func names(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
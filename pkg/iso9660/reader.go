@@ -0,0 +1,154 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// ReadFiles returns the regular files in the root directory of the image at
+// path. Names are taken from the Joliet volume when present, then from Rock
+// Ridge NM entries, and are derived from the ISO9660 identifiers otherwise.
+func ReadFiles(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Read(f, stat.Size())
+}
+
+// Read is like ReadFiles on an already opened image of size bytes. Sizes
+// read from the image are checked against it before allocating.
+func Read(r io.ReaderAt, size int64) (map[string][]byte, error) {
+	var root []byte
+	joliet := false
+	for sector := int64(firstDescriptorSector); ; sector++ {
+		if (sector+1)*sectorSize > size {
+			return nil, fmt.Errorf("no volume descriptor set terminator")
+		}
+		d := make([]byte, sectorSize)
+		if _, err := r.ReadAt(d, sector*sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read volume descriptor: %w", err)
+		}
+		if string(d[1:6]) != standardIdentifier {
+			return nil, fmt.Errorf("not an ISO9660 image")
+		}
+		if d[0] == 255 {
+			break
+		}
+		switch {
+		case d[0] == 1 && root == nil:
+			root = d[156:190]
+		case d[0] == 2 && isJolietEscape(d[88:91]):
+			root = d[156:190]
+			joliet = true
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no primary volume descriptor")
+	}
+	dir, err := readExtent(r, size, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root directory: %w", err)
+	}
+
+	files := make(map[string][]byte)
+	for offset := 0; offset < len(dir); {
+		length := int(dir[offset])
+		if length == 0 {
+			// Records never cross sector boundaries, the rest is padding.
+			offset += sectorSize - offset%sectorSize
+			continue
+		}
+		if length < 34 || offset+length > len(dir) {
+			return nil, fmt.Errorf("malformed directory record")
+		}
+		record := dir[offset : offset+length]
+		offset += length
+		idLength := int(record[32])
+		if 33+idLength > length {
+			return nil, fmt.Errorf("malformed directory record")
+		}
+		identifier := record[33 : 33+idLength]
+		if record[25]&2 != 0 || (idLength == 1 && identifier[0] <= 1) {
+			// Skip directories, including "." and "..".
+			continue
+		}
+		var name string
+		switch {
+		case joliet:
+			name = fromUCS2(identifier)
+		default:
+			systemUse := []byte{}
+			if start := 33 + idLength + (1 - idLength%2); start < length {
+				systemUse = record[start:]
+			}
+			if nm, ok := rockRidgeName(systemUse); ok {
+				name = nm
+			} else {
+				name = strings.ToLower(string(identifier))
+			}
+		}
+		name = strings.TrimSuffix(name, ";1")
+		if !joliet {
+			name = strings.TrimSuffix(name, ".")
+		}
+		data, err := readExtent(r, size, record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %w", name, err)
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// readExtent reads the data of a directory record, which must lie within
+// the image of imageSize bytes.
+func readExtent(r io.ReaderAt, imageSize int64, record []byte) ([]byte, error) {
+	offset := int64(binary.LittleEndian.Uint32(record[2:])) * sectorSize
+	size := int64(binary.LittleEndian.Uint32(record[10:]))
+	if offset+size > imageSize {
+		return nil, fmt.Errorf("extent of %v bytes at %v is past the end of the image", size, offset)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func isJolietEscape(b []byte) bool {
+	return b[0] == '%' && b[1] == '/' && bytes.IndexByte([]byte("@CE"), b[2]) >= 0
+}
+
+func fromUCS2(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// rockRidgeName looks for an alternate name (NM) entry in a System Use area.
+func rockRidgeName(b []byte) (string, bool) {
+	for len(b) >= 4 {
+		length := int(b[2])
+		if length < 4 || length > len(b) {
+			break
+		}
+		if string(b[:2]) == "NM" && length >= 5 {
+			return string(b[5:length]), true
+		}
+		b = b[length:]
+	}
+	return "", false
+}
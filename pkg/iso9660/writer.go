@@ -0,0 +1,292 @@
+// Package iso9660 reads and writes the small, flat ISO9660 images used as
+// cloud-init NoCloud seeds. Only regular files in the root directory are
+// supported; names are kept intact through a Joliet supplementary volume.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+	// Volume descriptors start right after the 16 sectors of system area.
+	firstDescriptorSector = 16
+)
+
+type dirEntry struct {
+	identifier []byte
+	extent     uint32
+	size       uint32
+}
+
+// Write writes an image labelled label containing files in its root directory.
+func Write(w io.Writer, label string, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name == "" || strings.ContainsAny(name, "/\x00") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		if len(utf16.Encode([]rune(name))) > 64 {
+			return fmt.Errorf("file name %q is too long", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Layout: descriptors (PVD, Joliet SVD, terminator), four path tables,
+	// both root directories, then file data.
+	var primary, joliet []dirEntry
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		size := uint32(len(files[name]))
+		primary = append(primary, dirEntry{identifier: []byte(primaryIdentifier(name, seen)), size: size})
+		joliet = append(joliet, dirEntry{identifier: ucs2(name), size: size})
+	}
+	next := uint32(firstDescriptorSector + 3)
+	pathTables := next
+	next += 4
+	primaryRoot, primaryRootSize := next, directorySize(primary)
+	next += primaryRootSize / sectorSize
+	jolietRoot, jolietRootSize := next, directorySize(joliet)
+	next += jolietRootSize / sectorSize
+	for i, name := range names {
+		primary[i].extent = next
+		joliet[i].extent = next
+		next += sectors(uint32(len(files[name])))
+	}
+	totalSectors := next
+	// Identifiers within a directory must be sorted.
+	sort.Slice(primary, func(i, j int) bool { return bytes.Compare(primary[i].identifier, primary[j].identifier) < 0 })
+	sort.Slice(joliet, func(i, j int) bool { return bytes.Compare(joliet[i].identifier, joliet[j].identifier) < 0 })
+
+	now := time.Now().UTC()
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, firstDescriptorSector*sectorSize))
+	buf.Write(volumeDescriptor(1, label, totalSectors, pathTables, pathTables+1, primaryRoot, primaryRootSize, now))
+	buf.Write(volumeDescriptor(2, label, totalSectors, pathTables+2, pathTables+3, jolietRoot, jolietRootSize, now))
+	terminator := make([]byte, sectorSize)
+	terminator[0] = 255
+	copy(terminator[1:], standardIdentifier)
+	terminator[6] = 1
+	buf.Write(terminator)
+	buf.Write(pathTable(primaryRoot, binary.LittleEndian))
+	buf.Write(pathTable(primaryRoot, binary.BigEndian))
+	buf.Write(pathTable(jolietRoot, binary.LittleEndian))
+	buf.Write(pathTable(jolietRoot, binary.BigEndian))
+	buf.Write(directory(primaryRoot, primaryRootSize, primary, now))
+	buf.Write(directory(jolietRoot, jolietRootSize, joliet, now))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for _, name := range names {
+		data := files[name]
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if pad := int(sectors(uint32(len(data))))*sectorSize - len(data); pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const standardIdentifier = "CD001"
+
+// jolietEscape selects UCS-2 level 3 in a supplementary volume descriptor.
+var jolietEscape = []byte("%/E")
+
+func volumeDescriptor(typ byte, label string, totalSectors, lPathTable, mPathTable, root, rootSize uint32, now time.Time) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = typ
+	copy(d[1:], standardIdentifier)
+	d[6] = 1
+	if typ == 2 {
+		copy(d[88:], jolietEscape)
+		fillUCS2(d[8:40], "")
+		fillUCS2(d[40:72], label)
+		for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+			fillUCS2(d[field[0]:field[1]], "")
+		}
+	} else {
+		fillString(d[8:40], "")
+		fillString(d[40:72], strings.ToUpper(label))
+		for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+			fillString(d[field[0]:field[1]], "")
+		}
+	}
+	putBoth32(d[80:], totalSectors)
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], lPathTable)
+	binary.BigEndian.PutUint32(d[148:], mPathTable)
+	copy(d[156:], directoryRecord([]byte{0}, root, rootSize, true, now))
+	copy(d[813:], decDateTime(now))
+	copy(d[830:], decDateTime(now))
+	copy(d[847:], decDateTime(time.Time{}))
+	copy(d[864:], decDateTime(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+// pathTableSize is the size of a path table holding only the root directory.
+const pathTableSize = 10
+
+func pathTable(root uint32, order binary.ByteOrder) []byte {
+	t := make([]byte, sectorSize)
+	t[0] = 1
+	order.PutUint32(t[2:], root)
+	order.PutUint16(t[6:], 1)
+	return t
+}
+
+func directorySize(entries []dirEntry) uint32 {
+	offset := uint32(0)
+	for _, record := range append([]int{34, 34}, recordLengths(entries)...) {
+		if offset%sectorSize+uint32(record) > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		offset += uint32(record)
+	}
+	return sectors(offset) * sectorSize
+}
+
+func recordLengths(entries []dirEntry) []int {
+	lengths := make([]int, len(entries))
+	for i, e := range entries {
+		lengths[i] = len(directoryRecord(e.identifier, 0, 0, false, time.Time{}))
+	}
+	return lengths
+}
+
+func directory(self, size uint32, entries []dirEntry, now time.Time) []byte {
+	d := make([]byte, size)
+	records := [][]byte{
+		directoryRecord([]byte{0}, self, size, true, now),
+		directoryRecord([]byte{1}, self, size, true, now),
+	}
+	for _, e := range entries {
+		records = append(records, directoryRecord(e.identifier, e.extent, e.size, false, now))
+	}
+	offset := 0
+	for _, r := range records {
+		if offset%sectorSize+len(r) > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		copy(d[offset:], r)
+		offset += len(r)
+	}
+	return d
+}
+
+func directoryRecord(identifier []byte, extent, size uint32, dir bool, now time.Time) []byte {
+	length := 33 + len(identifier)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBoth32(r[2:], extent)
+	putBoth32(r[10:], size)
+	if !now.IsZero() {
+		r[18] = byte(now.Year() - 1900)
+		r[19] = byte(now.Month())
+		r[20] = byte(now.Day())
+		r[21] = byte(now.Hour())
+		r[22] = byte(now.Minute())
+		r[23] = byte(now.Second())
+	}
+	if dir {
+		r[25] = 2
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(identifier))
+	copy(r[33:], identifier)
+	return r
+}
+
+// primaryIdentifier maps name to an ISO9660 level 2 file identifier, which
+// only readers without Joliet support ever see.
+func primaryIdentifier(name string, seen map[string]bool) string {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i+1] + strings.ReplaceAll(base[i+1:], ".", "_")
+	} else {
+		base += "."
+	}
+	if len(base) > 28 {
+		base = base[:28]
+	}
+	id := base
+	for n := 1; seen[id]; n++ {
+		id = fmt.Sprintf("%v%d", base[:len(base)-len(fmt.Sprint(n))], n)
+	}
+	seen[id] = true
+	return id + ";1"
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func fillString(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+func fillUCS2(b []byte, s string) {
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = 0, ' '
+	}
+	encoded := ucs2(s)
+	if len(encoded) > len(b)&^1 {
+		encoded = encoded[:len(b)&^1]
+	}
+	copy(b, encoded)
+}
+
+func decDateTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.Format("20060102150405")+"00"), 0)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func sectors(size uint32) uint32 {
+	return (size + sectorSize - 1) / sectorSize
+}
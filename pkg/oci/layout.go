@@ -0,0 +1,327 @@
+// Package oci writes single layer images as OCI image layout or
+// docker-archive tarballs, the formats `ctr image import` reads.
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationImageName is the annotation containerd names imported images after.
+const AnnotationImageName = "io.containerd.image.name"
+
+// File is a regular file of the image.
+type File struct {
+	// Name is the slash separated path in the image, e.g. disk/boot.qcow2.
+	Name string
+	// Path is the host file holding the content.
+	Path string
+}
+
+// Image describes a single layer image.
+type Image struct {
+	// Name is the normalized reference, e.g. docker.io/library/dev:latest.
+	Name string
+	// Tag is the reference name of the image in the layout, e.g. latest.
+	Tag    string
+	Files  []File
+	Labels map[string]string
+	// Annotations are set on the manifest, OCI layouts only.
+	Annotations  map[string]string
+	Created      time.Time
+	CreatedBy    string
+	OS           string
+	Architecture string
+}
+
+// WriteLayout writes img as an OCI image layout tarball at output and
+// returns the descriptor of its manifest.
+func WriteLayout(output string, img *Image) (ocispec.Descriptor, error) {
+	var desc ocispec.Descriptor
+	err := writeArchive(output, img, func(tw *tarWriter, layer *layerFile, config *blob) error {
+		manifest, err := jsonBlob(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      config.desc,
+			Layers:      []ocispec.Descriptor{layer.desc},
+			Annotations: img.Annotations,
+		})
+		if err != nil {
+			return err
+		}
+		desc = manifest.desc
+		desc.Platform = &ocispec.Platform{OS: img.OS, Architecture: img.Architecture}
+		desc.Annotations = map[string]string{
+			AnnotationImageName:       img.Name,
+			ocispec.AnnotationRefName: img.Tag,
+		}
+		index, err := json.Marshal(ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []ocispec.Descriptor{desc},
+		})
+		if err != nil {
+			return err
+		}
+		layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return err
+		}
+		tw.bytes(ocispec.ImageLayoutFile, layout)
+		tw.bytes("index.json", index)
+		tw.dir("blobs/")
+		tw.dir("blobs/sha256/")
+		for _, b := range []*blob{config, manifest} {
+			tw.bytes(blobPath(b.desc.Digest), b.data)
+		}
+		tw.file(blobPath(layer.desc.Digest), layer.path)
+		return nil
+	})
+	return desc, err
+}
+
+// dockerManifest is an entry of the manifest.json of a docker-archive, as
+// written by `docker save`.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// WriteDockerArchive writes img as a `docker save` tarball at output, tagged
+// as repoTag, and returns the descriptor of its config.
+func WriteDockerArchive(output, repoTag string, img *Image) (ocispec.Descriptor, error) {
+	var desc ocispec.Descriptor
+	err := writeArchive(output, img, func(tw *tarWriter, layer *layerFile, config *blob) error {
+		desc = config.desc
+		layerDir := layer.desc.Digest.Encoded()
+		manifest, err := json.Marshal([]dockerManifest{{
+			Config:   config.desc.Digest.Encoded() + ".json",
+			RepoTags: []string{repoTag},
+			Layers:   []string{layerDir + "/layer.tar"},
+		}})
+		if err != nil {
+			return err
+		}
+		tw.bytes(config.desc.Digest.Encoded()+".json", config.data)
+		tw.dir(layerDir + "/")
+		tw.file(layerDir+"/layer.tar", layer.path)
+		tw.bytes("manifest.json", manifest)
+		return nil
+	})
+	return desc, err
+}
+
+// writeArchive builds the layer and config of img and lets write add them
+// to the tarball at output. The tarball is written next to output first,
+// so that output is never left partially written.
+func writeArchive(output string, img *Image, write func(*tarWriter, *layerFile, *blob) error) error {
+	dir := filepath.Dir(output)
+	layer, err := writeLayer(dir, img)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.path)
+
+	created := img.Created.UTC()
+	config, err := jsonBlob(ocispec.MediaTypeImageConfig, ocispec.Image{
+		Created:      &created,
+		Architecture: img.Architecture,
+		OS:           img.OS,
+		Config:       ocispec.ImageConfig{Labels: img.Labels},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layer.desc.Digest},
+		},
+		History: []ocispec.History{{Created: &created, CreatedBy: img.CreatedBy}},
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".image-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	tw := newTarWriter(f, img.Created)
+	if err := write(tw, layer, config); err != nil {
+		return err
+	}
+	if err := tw.close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), output)
+}
+
+type blob struct {
+	desc ocispec.Descriptor
+	data []byte
+}
+
+func jsonBlob(mediaType string, v interface{}) (*blob, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &blob{
+		desc: ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))},
+		data: data,
+	}, nil
+}
+
+type layerFile struct {
+	desc ocispec.Descriptor
+	path string
+}
+
+// writeLayer writes the uncompressed layer tar of img to a temporary file
+// in dir. Disk images are large and usually compressed already, so the
+// layer is left uncompressed and its digest is also its diff ID.
+func writeLayer(dir string, img *Image) (*layerFile, error) {
+	f, err := os.CreateTemp(dir, ".layer-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{w: io.MultiWriter(f, digester.Hash())}
+	tw := newTarWriter(counter, img.Created)
+	files := append([]File(nil), img.Files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		for _, parent := range parents(file.Name) {
+			if !dirs[parent] {
+				dirs[parent] = true
+				tw.dir(parent + "/")
+			}
+		}
+		tw.file(file.Name, file.Path)
+	}
+	err = tw.close()
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &layerFile{
+		desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digester.Digest(),
+			Size:      counter.n,
+		},
+		path: f.Name(),
+	}, nil
+}
+
+// parents returns the parent directories of the slash separated name,
+// outermost first.
+func parents(name string) []string {
+	var res []string
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		res = append([]string{dir}, res...)
+	}
+	return res
+}
+
+func blobPath(d digest.Digest) string {
+	return path.Join("blobs", d.Algorithm().String(), d.Encoded())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarWriter writes root owned entries with a fixed modification time, so
+// that the same content always gives the same digests. The first error is
+// kept and returned by close.
+type tarWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+	err     error
+}
+
+func newTarWriter(w io.Writer, modTime time.Time) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), modTime: modTime.UTC().Truncate(time.Second)}
+}
+
+func (t *tarWriter) header(name string, typeflag byte, mode, size int64) {
+	if t.err != nil {
+		return
+	}
+	t.err = t.tw.WriteHeader(&tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		ModTime:  t.modTime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (t *tarWriter) dir(name string) {
+	t.header(name, tar.TypeDir, 0755, 0)
+}
+
+func (t *tarWriter) bytes(name string, data []byte) {
+	t.header(name, tar.TypeReg, 0644, int64(len(data)))
+	if t.err == nil {
+		_, t.err = t.tw.Write(data)
+	}
+}
+
+func (t *tarWriter) file(name, hostPath string) {
+	if t.err != nil {
+		return
+	}
+	f, err := os.Open(hostPath)
+	if err != nil {
+		t.err = err
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		t.err = err
+		return
+	}
+	t.header(name, tar.TypeReg, 0644, stat.Size())
+	if t.err != nil {
+		return
+	}
+	if _, err := io.Copy(t.tw, f); err != nil {
+		t.err = fmt.Errorf("failed to write %v: %w", name, err)
+	}
+}
+
+func (t *tarWriter) close() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.tw.Close()
+}
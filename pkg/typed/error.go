@@ -1,5 +1,33 @@
 package typed
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 var ErrNotImplemented = errors.New("not implemented")
+
+var (
+	ErrDirtyImage         = errors.New("image is dirty")
+	ErrCorruptImage       = errors.New("image is corrupt")
+	ErrUnsafeBackingChain = errors.New("unsafe backing chain")
+	ErrEncryptedImage     = errors.New("image is encrypted")
+)
+
+// ImageIntegrityError tells why an image in a backing chain was refused.
+// Err is one of ErrDirtyImage, ErrCorruptImage, ErrUnsafeBackingChain or
+// ErrEncryptedImage.
+type ImageIntegrityError struct {
+	Path   string
+	Reason string
+	Err    error
+}
+
+func (e *ImageIntegrityError) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Path, e.Err, e.Reason)
+}
+
+func (e *ImageIntegrityError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,28 @@
+// Package vsock opens virtio-vsock stream sockets as net.Listener and
+// net.Conn, which the standard library doesn't support.
+package vsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrUnsupported is returned on hosts without AF_VSOCK.
+var ErrUnsupported = errors.New("vsock is not supported on this host")
+
+// Addr is a vsock address.
+type Addr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a *Addr) Network() string {
+	return "vsock"
+}
+
+func (a *Addr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+var _ net.Addr = &Addr{}
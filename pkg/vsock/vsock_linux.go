@@ -0,0 +1,126 @@
+package vsock
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported tells whether the host has AF_VSOCK.
+const Supported = true
+
+// Listen listens on port for connections of any CID.
+func Listen(port uint32) (net.Listener, error) {
+	fd, err := socket()
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port})
+	if err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return &listener{
+		f:    os.NewFile(uintptr(fd), "vsock"),
+		addr: &Addr{CID: unix.VMADDR_CID_ANY, Port: port},
+	}, nil
+}
+
+// Dial connects to port of the VM having cid.
+func Dial(cid, port uint32) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// Connect before switching to non-blocking mode, which would need
+	// polling for the connection to complete.
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	return newConn(fd, &Addr{CID: cid, Port: port})
+}
+
+func socket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		if err == unix.EAFNOSUPPORT {
+			return -1, ErrUnsupported
+		}
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+func newConn(fd int, remote *Addr) (net.Conn, error) {
+	var local net.Addr = &Addr{}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			local = &Addr{CID: vm.CID, Port: vm.Port}
+		}
+	}
+	// Non-blocking descriptors are handled by the runtime poller, which
+	// makes reads interruptible by Close and deadlines.
+	return &conn{File: os.NewFile(uintptr(fd), "vsock"), local: local, remote: remote}, nil
+}
+
+type listener struct {
+	f    *os.File
+	addr *Addr
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	raw, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fd    int
+		sa    unix.Sockaddr
+		opErr error
+	)
+	err = raw.Read(func(s uintptr) bool {
+		fd, sa, opErr = unix.Accept4(int(s), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return opErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opErr != nil {
+		return nil, os.NewSyscallError("accept", opErr)
+	}
+	remote := &Addr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = &Addr{CID: vm.CID, Port: vm.Port}
+	}
+	return newConn(fd, remote)
+}
+
+func (l *listener) Close() error {
+	return l.f.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+type conn struct {
+	*os.File
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
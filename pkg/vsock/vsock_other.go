@@ -0,0 +1,18 @@
+//go:build !linux
+
+package vsock
+
+import "net"
+
+// Supported tells whether the host has AF_VSOCK.
+const Supported = false
+
+// Listen listens on port for connections of any CID.
+func Listen(port uint32) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// Dial connects to port of the VM having cid.
+func Dial(cid, port uint32) (net.Conn, error) {
+	return nil, ErrUnsupported
+}